@@ -0,0 +1,185 @@
+package eventsource
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// The media type of the binary framing written by a BinaryEncoder. The Server's handlers send events in it, in
+// place of the text event stream, to clients whose Accept header asks for it, so that Go programs consuming events
+// at a high rate can use a BinaryDecoder while browsers are still sent text.
+const BinaryContentType = "application/x-eventsource-binary"
+
+// The bits of a frame's flags
+const (
+	// The frame has an id field, which is empty for ResetId
+	frameID = 1 << iota
+	// The frame is a comment, holding its text as data, rather than an event
+	frameComment
+)
+
+// A BinaryEncoder writes Events to a stream in a compact binary framing, which a BinaryDecoder reads. Each event is
+// a frame of a flags byte followed by its id, name, retry delay in milliseconds and data, each string preceded by
+// its length, with the lengths and the delay written as uvarints. Unlike the text format, no field names are sent,
+// data spanning lines needs no splitting and data which isn't text needs no base64 encoding.
+type BinaryEncoder struct {
+	// Batches and flushes as it does for the text format
+	enc *Encoder
+	buf []byte
+}
+
+// Create a BinaryEncoder writing to w
+func NewBinaryEncoder(w io.Writer) *BinaryEncoder {
+	return &BinaryEncoder{enc: NewEncoder(w)}
+}
+
+// Batch buffers whatever is written from now on until Flush is called, as Encoder.Batch does.
+func (enc *BinaryEncoder) Batch() {
+	enc.enc.Batch()
+}
+
+// Flush writes out anything buffered since Batch was called, ending the batch, then flushes the underlying
+// writer if it supports it.
+func (enc *BinaryEncoder) Flush() error {
+	return enc.enc.Flush()
+}
+
+// Encode writes ev as a single frame. Any id, name and data can be written, as nothing needs escaping.
+func (enc *BinaryEncoder) Encode(ev Event) error {
+	var flags byte
+	id := ev.Id()
+	if len(id) > 0 {
+		flags |= frameID
+	}
+	if id == ResetId {
+		id = ""
+	}
+	var delay uint64
+	if r, ok := ev.(Retrier); ok && r.Retry() > 0 {
+		delay = uint64(r.Retry() / time.Millisecond)
+	}
+	return enc.write(flags, id, ev.Event(), delay, ev.Data())
+}
+
+// Comment writes text as a comment, which a BinaryDecoder skips or sends to its Comments, and flushes the
+// underlying writer like Flush.
+func (enc *BinaryEncoder) Comment(text string) error {
+	if err := enc.write(frameComment, "", "", 0, text); err != nil {
+		return err
+	}
+	return enc.Flush()
+}
+
+func (enc *BinaryEncoder) write(flags byte, id, name string, delay uint64, data string) error {
+	enc.buf = append(enc.buf[:0], flags)
+	enc.buf = binary.AppendUvarint(enc.buf, uint64(len(id)))
+	enc.buf = append(enc.buf, id...)
+	enc.buf = binary.AppendUvarint(enc.buf, uint64(len(name)))
+	enc.buf = append(enc.buf, name...)
+	enc.buf = binary.AppendUvarint(enc.buf, delay)
+	enc.buf = binary.AppendUvarint(enc.buf, uint64(len(data)))
+	// The data, which may be large, is written as it is rather than copied
+	if _, err := enc.enc.w.Write(enc.buf); err != nil {
+		return fmt.Errorf("Eventsource: Encode: %s", err)
+	}
+	if _, err := io.WriteString(enc.enc.w, data); err != nil {
+		return fmt.Errorf("Eventsource: Encode: %s", err)
+	}
+	return nil
+}
+
+// A BinaryDecoder reads Events written by a BinaryEncoder, such as those sent by the Server's handlers to clients
+// which accept BinaryContentType.
+type BinaryDecoder struct {
+	r *bufio.Reader
+	// If set, the text of each comment is sent to Comments as it is read,
+	// for instance to observe keepalives. Decode blocks until it's received.
+	Comments chan string
+	// The largest event which will be decoded, counting its id, name and
+	// data, so that a corrupt length can't exhaust memory. Defaults to
+	// DefaultMaxEventSize.
+	MaxEventSize int
+}
+
+// Create a BinaryDecoder reading from r
+func NewBinaryDecoder(r io.Reader) *BinaryDecoder {
+	return &BinaryDecoder{r: bufio.NewReader(r)}
+}
+
+// Decode reads the next Event from a stream, blocking until one comes in, and skipping comments. The Event
+// implements Retrier and Binary like those returned by a Decoder, its Bytes being its data as it was sent. A
+// stream ending between events is indicated by io.EOF, and one ending partway through an event by a
+// *MalformedEventError. An event larger than the MaxEventSize returns ErrEventTooLarge, after which the rest
+// of the stream can't be decoded.
+func (dec *BinaryDecoder) Decode() (Event, error) {
+	for {
+		flags, err := dec.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		pub, err := dec.frame(flags)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, &MalformedEventError{io.ErrUnexpectedEOF}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if flags&frameComment != 0 {
+			if dec.Comments != nil {
+				dec.Comments <- pub.data
+			}
+			continue
+		}
+		return pub, nil
+	}
+}
+
+// Reads the rest of a frame following its flags
+func (dec *BinaryDecoder) frame(flags byte) (pub *publication, err error) {
+	pub = new(publication)
+	size := 0
+	if pub.id, err = dec.field(&size); err != nil {
+		return
+	}
+	if flags&frameID != 0 && len(pub.id) == 0 {
+		pub.id = ResetId
+	}
+	if pub.event, err = dec.field(&size); err != nil {
+		return
+	}
+	delay, err := binary.ReadUvarint(dec.r)
+	if err != nil {
+		return
+	}
+	// Delays too long to represent are ignored, as unparseable ones are in the text format
+	if delay <= math.MaxInt64/uint64(time.Millisecond) {
+		pub.retry = time.Duration(delay) * time.Millisecond
+	}
+	pub.data, err = dec.field(&size)
+	return
+}
+
+// Reads a string preceded by its length, adding the length to size
+func (dec *BinaryDecoder) field(size *int) (string, error) {
+	limit := dec.MaxEventSize
+	if limit <= 0 {
+		limit = DefaultMaxEventSize
+	}
+	n, err := binary.ReadUvarint(dec.r)
+	if err != nil {
+		return "", err
+	}
+	if n > uint64(limit-*size) {
+		return "", ErrEventTooLarge
+	}
+	*size += int(n)
+	buf := make([]byte, n)
+	if _, err = io.ReadFull(dec.r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
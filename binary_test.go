@@ -0,0 +1,136 @@
+package eventsource
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBinaryRoundTrip(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := NewBinaryEncoder(buf)
+	events := []Event{
+		&testEvent{"1", "Add", "This is a test"},
+		&testEvent{"", "", "Spans\r\nlines\n"},
+		&testEvent{ResetId, "", "Empty id"},
+		&testEvent{"2", "id: injected\n", string([]byte{0, 1, 0xff})},
+		&retryEvent{testEvent{"3", "", "reconnect slowly"}, 30 * time.Second},
+	}
+	enc.Encode(events[0])
+	enc.Comment("keepalive")
+	for _, ev := range events[1:] {
+		if err := enc.Encode(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dec := NewBinaryDecoder(buf)
+	dec.Comments = make(chan string, 1)
+	for _, want := range events {
+		ev, err := dec.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !EventsEqual(ev, want) {
+			t.Errorf("Expected: %+v Got: %+v", want, ev)
+		}
+	}
+	if comment := <-dec.Comments; comment != "keepalive" {
+		t.Errorf("Expected: keepalive Got: %q", comment)
+	}
+	if _, err := dec.Decode(); err != io.EOF {
+		t.Errorf("Expected: %s Got: %v", io.EOF, err)
+	}
+}
+
+func TestBinaryDecoderErrors(t *testing.T) {
+	buf := new(bytes.Buffer)
+	NewBinaryEncoder(buf).Encode(&testEvent{"1", "", strings.Repeat("x", 100)})
+	dec := NewBinaryDecoder(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	var malformed *MalformedEventError
+	if _, err := dec.Decode(); !errors.As(err, &malformed) {
+		t.Errorf("Expected: MalformedEventError Got: %v", err)
+	}
+	dec = NewBinaryDecoder(bytes.NewReader(buf.Bytes()))
+	dec.MaxEventSize = 50
+	if _, err := dec.Decode(); err != ErrEventTooLarge {
+		t.Errorf("Expected: %s Got: %v", ErrEventTooLarge, err)
+	}
+}
+
+func TestBinaryHandler(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.Preamble = []byte(": preamble\n")
+	srv.ResponseHeaders = http.Header{"Content-Type": {"text/event-stream"}}
+	ts := httptest.NewServer(srv.Handler("test"))
+	defer ts.Close()
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	req.Header.Set("Accept", BinaryContentType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != BinaryContentType {
+		t.Errorf("Expected: %s Got: %s", BinaryContentType, got)
+	}
+	for srv.SubscriberCount("test") != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	want := &testEvent{"1", "update", "two\nlines"}
+	srv.Publish([]string{"test"}, want)
+	ev, err := NewBinaryDecoder(resp.Body).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !EventsEqual(ev, want) {
+		t.Errorf("Expected: %+v Got: %+v", want, ev)
+	}
+}
+
+func BenchmarkCodecs(b *testing.B) {
+	ev := &testEvent{"12345", "update", `{"price":101.5,"symbol":"ABC","volume":1200}`}
+	b.Run("text/encode", func(b *testing.B) {
+		enc := NewEncoder(io.Discard)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			enc.Encode(ev)
+		}
+	})
+	b.Run("binary/encode", func(b *testing.B) {
+		enc := NewBinaryEncoder(io.Discard)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			enc.Encode(ev)
+		}
+	})
+	text, bin := new(bytes.Buffer), new(bytes.Buffer)
+	textEnc, binEnc := NewEncoder(text), NewBinaryEncoder(bin)
+	for i := 0; i < 1000; i++ {
+		textEnc.Encode(ev)
+		binEnc.Encode(ev)
+	}
+	b.Run("text/decode", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(text.Len()))
+		for i := 0; i < b.N; i++ {
+			dec := NewDecoder(bytes.NewReader(text.Bytes()))
+			for _, err := dec.Decode(); err == nil; _, err = dec.Decode() {
+			}
+		}
+	})
+	b.Run("binary/decode", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(bin.Len()))
+		for i := 0; i < b.N; i++ {
+			dec := NewBinaryDecoder(bytes.NewReader(bin.Bytes()))
+			for _, err := dec.Decode(); err == nil; _, err = dec.Decode() {
+			}
+		}
+	})
+}
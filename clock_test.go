@@ -0,0 +1,271 @@
+package eventsource
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A clock whose time only passes when it's advanced
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeTicker
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0)}
+}
+
+// Fires after a period, again and again if it's a ticker
+type fakeTicker struct {
+	clock  *fakeClock
+	at     time.Time
+	period time.Duration
+	repeat bool
+	c      chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) wait(d time.Duration, repeat bool) *fakeTicker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTicker{c, c.now.Add(d), d, repeat, make(chan time.Time, 1)}
+	c.waiters = append(c.waiters, t)
+	return t
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time { return c.wait(d, false).c }
+func (c *fakeClock) NewTicker(d time.Duration) ticker       { return c.wait(d, true) }
+
+// Reports how many timers and tickers are waiting to fire
+func (c *fakeClock) waiting() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, t := range c.waiters {
+		if t.at.After(c.now) {
+			waiters = append(waiters, t)
+			continue
+		}
+		select {
+		case t.c <- c.now:
+		default:
+		}
+		if t.repeat {
+			t.at = c.now.Add(t.period)
+			waiters = append(waiters, t)
+		}
+	}
+	c.waiters = waiters
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.c }
+
+func (t *fakeTicker) Reset(d time.Duration) {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.at, t.period = t.clock.now.Add(d), d
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	for i, w := range t.clock.waiters {
+		if w == t {
+			t.clock.waiters = append(t.clock.waiters[:i], t.clock.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+func TestKeepAliveClock(t *testing.T) {
+	clock := newFakeClock()
+	srv := NewServer()
+	defer srv.Close()
+	srv.clock = clock
+	srv.KeepAlive = time.Hour
+	ts := httptest.NewServer(srv.Handler("test"))
+	defer ts.Close()
+	dec, done := subscribe(t, ts.URL, nil)
+	defer done()
+	dec.Comments = make(chan string, 1)
+	go dec.Decode()
+	for clock.waiting() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(time.Hour)
+	select {
+	case comment := <-dec.Comments:
+		if comment != "keepalive" {
+			t.Errorf("Expected: keepalive Got: %s", comment)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a keepalive once the clock passed the KeepAlive")
+	}
+}
+
+func TestHeartbeatByte(t *testing.T) {
+	clock := newFakeClock()
+	srv := NewServer()
+	defer srv.Close()
+	srv.clock = clock
+	srv.KeepAlive = time.Hour
+	srv.HeartbeatByte = true
+	ts := httptest.NewServer(srv.Handler("test"))
+	defer ts.Close()
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	for clock.waiting() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(time.Hour)
+	body := make([]byte, 1)
+	if _, err := io.ReadFull(resp.Body, body); err != nil || body[0] != '\n' {
+		t.Errorf("Expected a newline Got: %q %v", body, err)
+	}
+	srv.Publish([]string{"test"}, &testEvent{"1", "", "after"})
+	// The blank line doesn't disturb the events which follow
+	ev, err := NewDecoder(resp.Body).Decode()
+	if err != nil || ev.Id() != "1" {
+		t.Errorf("Expected id: 1 Got: %v %v", ev, err)
+	}
+}
+
+func TestStreamRetryClock(t *testing.T) {
+	clock := newFakeClock()
+	ts, connections := newDroppingServer(time.Hour)
+	defer ts.Close()
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := NewStream("", http.DefaultClient, req)
+	stream.clock = clock
+	if err := stream.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	drainErrors(stream)
+	<-stream.Events
+	<-connections
+	for clock.waiting() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-connections:
+		t.Fatal("Expected to wait for the retry delay before reconnecting")
+	case <-time.After(10 * time.Millisecond):
+	}
+	// DefaultBackoff waits for the retry delay plus up to as much again
+	clock.Advance(2 * time.Hour)
+	if ev := <-stream.Events; ev.Id() != "2" {
+		t.Errorf("Expected id: 2 Got: %s", ev.Id())
+	}
+}
+
+// A ResponseWriter counting the events written to it and the flushes
+type flushCounter struct {
+	mu      sync.Mutex
+	header  http.Header
+	body    strings.Builder
+	flushes int
+}
+
+func (w *flushCounter) Header() http.Header { return w.header }
+func (w *flushCounter) WriteHeader(int)     {}
+
+func (w *flushCounter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.body.Write(p)
+}
+
+func (w *flushCounter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.flushes++
+}
+
+// Waits until n events have been written and the handler is waiting to flush
+// them, then returns the number of flushes so far
+func (w *flushCounter) written(clock *fakeClock, n int) int {
+	for {
+		w.mu.Lock()
+		events, flushes := strings.Count(w.body.String(), "\n\n"), w.flushes
+		w.mu.Unlock()
+		if events == n && clock.waiting() == 1 {
+			return flushes
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Waits until there have been at least n flushes, returning how many
+func (w *flushCounter) flushed(n int) int {
+	for {
+		w.mu.Lock()
+		flushes := w.flushes
+		w.mu.Unlock()
+		if flushes >= n {
+			return flushes
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFlushInterval(t *testing.T) {
+	clock := newFakeClock()
+	srv := NewServer()
+	defer srv.Close()
+	srv.clock = clock
+	srv.FlushInterval = time.Second
+	w := &flushCounter{header: make(http.Header)}
+	go srv.Handler("test")(w, httptest.NewRequest("GET", "/", nil))
+	for srv.SubscriberCount("test") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	srv.Publish([]string{"test"}, &testEvent{"1", "", "first"})
+	// Those flushed when subscribing
+	flushes := w.written(clock, 1)
+	srv.Publish([]string{"test"}, &testEvent{"2", "", "second"})
+	srv.Publish([]string{"test"}, &testEvent{"3", "", "third"})
+	if n := w.written(clock, 3); n != flushes {
+		t.Errorf("Expected no flushes within the interval Got: %d", n-flushes)
+	}
+	clock.Advance(srv.FlushInterval)
+	if n := w.flushed(flushes + 1); n != flushes+1 {
+		t.Errorf("Expected the events to be flushed together Got: %d flushes", n-flushes)
+	}
+	srv.Publish([]string{"test"}, &testEvent{"4", "", "lone"})
+	if n := w.written(clock, 4); n != flushes+1 {
+		t.Errorf("Expected the lone event to wait for the interval Got: %d flushes", n-flushes)
+	}
+	clock.Advance(srv.FlushInterval / 2)
+	if n := w.written(clock, 4); n != flushes+1 {
+		t.Errorf("Expected the lone event to wait for the interval Got: %d flushes", n-flushes)
+	}
+	clock.Advance(srv.FlushInterval / 2)
+	if n := w.flushed(flushes + 2); n != flushes+2 {
+		t.Errorf("Expected the lone event to be flushed once Got: %d flushes", n-flushes-1)
+	}
+}
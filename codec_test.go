@@ -2,7 +2,18 @@ package eventsource
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 type testEvent struct {
@@ -19,19 +30,23 @@ var encoderTests = []struct {
 }{
 	{&testEvent{"1", "Add", "This is a test"}, "id: 1\nevent: Add\ndata: This is a test\n\n"},
 	{&testEvent{"", "", "This message, it\nhas two lines."}, "data: This message, it\ndata: has two lines.\n\n"},
+	{&testEvent{"2", "", "This one\n\nhas a blank line."}, "id: 2\ndata: This one\ndata: \ndata: has a blank line.\n\n"},
+	{&testEvent{"", "", "Trailing newline\n"}, "data: Trailing newline\ndata: \n\n"},
+	{&testEvent{"", "", "No id"}, "data: No id\n\n"},
+	{&testEvent{ResetId, "", "Empty id"}, "id\ndata: Empty id\n\n"},
 }
 
 func TestRoundTrip(t *testing.T) {
 	buf := new(bytes.Buffer)
-	enc := newEncoder(buf)
-	dec := newDecoder(buf)
+	enc := NewEncoder(buf)
+	dec := NewDecoder(buf)
 	for _, tt := range encoderTests {
 		want := tt.event
 		if err := enc.Encode(want); err != nil {
 			t.Fatal(err)
 		}
 		if buf.String() != tt.output {
-			t.Errorf("Expected: %s Got: %s", tt.output, buf.String())
+			t.Errorf("Expected: %q Got: %q", tt.output, buf.String())
 		}
 		ev, err := dec.Decode()
 		if err != nil {
@@ -42,3 +57,538 @@ func TestRoundTrip(t *testing.T) {
 		}
 	}
 }
+
+func TestMultiLineJSON(t *testing.T) {
+	data, err := json.MarshalIndent(map[string]interface{}{
+		"title": "Multi-line",
+		"tags":  []string{"a", "b"},
+	}, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := NewEncoder(buf).Encode(&testEvent{"1", "json", string(data)}); err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(buf.Bytes(), []byte("data: ")); lines != bytes.Count(data, []byte("\n"))+1 {
+		t.Errorf("Expected one data field per line, got %d in %q", lines, buf.String())
+	}
+	ev, err := NewDecoder(buf).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Data() != string(data) {
+		t.Errorf("Expected: %q Got: %q", data, ev.Data())
+	}
+}
+
+type retryEvent struct {
+	testEvent
+	retry time.Duration
+}
+
+func (e *retryEvent) Retry() time.Duration { return e.retry }
+
+func TestRetry(t *testing.T) {
+	buf := new(bytes.Buffer)
+	want := &retryEvent{testEvent{"1", "", "reconnect slowly"}, 30 * time.Second}
+	if err := NewEncoder(buf).Encode(want); err != nil {
+		t.Fatal(err)
+	}
+	if output := "id: 1\nretry: 30000\ndata: reconnect slowly\n\n"; buf.String() != output {
+		t.Errorf("Expected: %q Got: %q", output, buf.String())
+	}
+	ev, err := NewDecoder(buf).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retry := ev.(*publication).Retry(); retry != want.retry {
+		t.Errorf("Expected retry: %s Got: %s", want.retry, retry)
+	}
+}
+
+func TestComment(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	if err := enc.Comment("connected\ndata: not a field"); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Encode(&testEvent{"1", "", "after the comment"}); err != nil {
+		t.Fatal(err)
+	}
+	if output := ": connected\n: data: not a field\nid: 1\ndata: after the comment\n\n"; buf.String() != output {
+		t.Errorf("Expected: %q Got: %q", output, buf.String())
+	}
+	ev, err := NewDecoder(buf).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Id() != "1" || ev.Data() != "after the comment" {
+		t.Errorf("Expected: 1 after the comment Got: %s %s", ev.Id(), ev.Data())
+	}
+}
+
+func TestWriteField(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	for _, field := range [][2]string{{"x-trace", "abc\ndef"}, {"data", "payload"}, {"x-flag", ""}} {
+		if err := enc.WriteField(field[0], field[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf.WriteString("\n")
+	if output := "x-trace: abc\nx-trace: def\ndata: payload\nx-flag\n\n"; buf.String() != output {
+		t.Errorf("Expected: %q Got: %q", output, buf.String())
+	}
+	ev, err := NewDecoder(buf).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Data() != "payload" {
+		t.Errorf("Expected: payload Got: %s", ev.Data())
+	}
+}
+
+func TestDecodeRetry(t *testing.T) {
+	input := "retry: 1500\ndata: valid\n\n" +
+		"retry: soon\ndata: not a number\n\n" +
+		"retry: -5\ndata: negative\n\n" +
+		"retry: +5\ndata: signed\n\n" +
+		"retry: 15 \ndata: trailing space\n\n" +
+		"retry\ndata: no value\n\n"
+	dec := NewDecoder(bytes.NewBufferString(input))
+	for _, want := range []time.Duration{1500 * time.Millisecond, 0, 0, 0, 0, 0} {
+		ev, err := dec.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if retry := ev.(Retrier).Retry(); retry != want {
+			t.Errorf("Decoding %q Expected retry: %s Got: %s", ev.Data(), want, retry)
+		}
+	}
+}
+
+func TestDecodeComments(t *testing.T) {
+	input := ": connected\n\n" +
+		"data: first\n: between fields\ndata: event\n\n" +
+		":keepalive\n\n" +
+		": keepalive\n" +
+		"id: 2\ndata: second event\n\n" +
+		":\n"
+	dec := NewDecoder(bytes.NewBufferString(input))
+	dec.Comments = make(chan string, 8)
+	for _, want := range []string{"first\nevent", "second event"} {
+		ev, err := dec.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.Data() != want {
+			t.Errorf("Expected: %q Got: %q", want, ev.Data())
+		}
+	}
+	if _, err := dec.Decode(); err != io.EOF {
+		t.Errorf("Expected: %s Got: %v", io.EOF, err)
+	}
+	close(dec.Comments)
+	want := []string{"connected", "between fields", "keepalive", "keepalive", ""}
+	i := 0
+	for comment := range dec.Comments {
+		if i >= len(want) || comment != want[i] {
+			t.Errorf("Expected comments: %q Got: %q at %d", want, comment, i)
+		}
+		i++
+	}
+}
+
+func TestMaxEventSize(t *testing.T) {
+	long := "data: " + strings.Repeat("x", 10000) + "\n"
+	dec := NewDecoder(strings.NewReader("data: small\n\n" + long + "\n" + long + long + "\n"))
+	dec.MaxEventSize = 15000
+	for _, want := range []error{nil, nil, ErrEventTooLarge} {
+		if _, err := dec.Decode(); err != want {
+			t.Errorf("Expected: %v Got: %v", want, err)
+		}
+	}
+	// Never terminated
+	dec = NewDecoder(io.MultiReader(strings.NewReader("data: "), infinite('x')))
+	if _, err := dec.Decode(); err != ErrEventTooLarge {
+		t.Errorf("Expected: %v Got: %v", ErrEventTooLarge, err)
+	}
+}
+
+func TestEventString(t *testing.T) {
+	dec := NewDecoder(strings.NewReader("id: 1\nevent: update\nretry: 500\ndata: two\ndata: lines\n\n"))
+	ev, err := dec.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "id: 1\nevent: update\nretry: 500\ndata: two\ndata: lines\n\n"; fmt.Sprint(ev) != want {
+		t.Errorf("Expected: %q Got: %q", want, fmt.Sprint(ev))
+	}
+}
+
+func TestEventsEqual(t *testing.T) {
+	decoded, err := NewDecoder(strings.NewReader("id: 1\ndata: same\n\n")).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		a, b  Event
+		equal bool
+	}{
+		{decoded, &testEvent{"1", "", "same"}, true},
+		{decoded, BytesEvent("1", "", []byte("same")), true},
+		{decoded, &testEvent{"2", "", "same"}, false},
+		{decoded, &testEvent{"1", "named", "same"}, false},
+		{decoded, &testEvent{"1", "", "different"}, false},
+		{decoded, &retryEvent{testEvent{"1", "", "same"}, time.Second}, false},
+		{decoded, nil, false},
+		{nil, nil, true},
+	} {
+		if got := EventsEqual(tt.a, tt.b); got != tt.equal {
+			t.Errorf("Comparing %v and %v Expected: %v Got: %v", tt.a, tt.b, tt.equal, got)
+		}
+	}
+}
+
+func TestMalformedEvent(t *testing.T) {
+	dec := NewDecoder(strings.NewReader("data: whole\n\n: comment\n\ndata: cut off"))
+	if _, err := dec.Decode(); err != nil {
+		t.Fatal(err)
+	}
+	var malformed *MalformedEventError
+	if _, err := dec.Decode(); !errors.As(err, &malformed) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected: MalformedEventError Got: %v", err)
+	}
+	// Only a comment follows the last event
+	dec = NewDecoder(strings.NewReader("data: whole\n\n: keepalive\n"))
+	dec.Decode()
+	if _, err := dec.Decode(); err != io.EOF {
+		t.Errorf("Expected: %s Got: %v", io.EOF, err)
+	}
+}
+
+type infinite byte
+
+func (b infinite) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(b)
+	}
+	return len(p), nil
+}
+
+func TestJSONEvent(t *testing.T) {
+	want := map[string]string{"title": "JSON", "content": "spans\nlines"}
+	ev, err := JSONEvent("1", "article", want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := NewEncoder(buf).Encode(ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev, err = NewDecoder(buf).Decode(); err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]string
+	if err := json.Unmarshal([]byte(ev.Data()), &got); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Id() != "1" || ev.Event() != "article" || got["content"] != want["content"] {
+		t.Errorf("Expected: 1 article %v Got: %s %s %v", want, ev.Id(), ev.Event(), got)
+	}
+	if _, err := JSONEvent("2", "", make(chan int)); err == nil {
+		t.Error("Expected an error marshaling a channel")
+	}
+}
+
+func TestEventName(t *testing.T) {
+	ev, err := JSONEvent("1", "named", "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name, output string
+	}{
+		{"named", "id: 1\nevent: named\ndata: \"data\"\n\n"},
+		{"", "id: 1\ndata: \"data\"\n\n"},
+		{"renamed", "id: 1\nevent: renamed\ndata: \"data\"\n\n"},
+	} {
+		ev.(interface{ SetEvent(string) }).SetEvent(tt.name)
+		buf := new(bytes.Buffer)
+		if err := NewEncoder(buf).Encode(ev); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.output {
+			t.Errorf("Expected: %q Got: %q", tt.output, buf.String())
+		}
+	}
+}
+
+func TestDecoderOn(t *testing.T) {
+	dec := NewDecoder(strings.NewReader("data: hello\n\nevent: ping\ndata: 1\n\nevent: other\ndata: ignored\n\nevent: ping\ndata: 2\n\n"))
+	var got []string
+	dec.On("message", func(ev Event) { got = append(got, "message "+ev.Data()) })
+	dec.On("ping", func(ev Event) { got = append(got, "ping "+ev.Data()) })
+	if err := dec.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"message hello", "ping 1", "ping 2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected: %v Got: %v", want, got)
+	}
+}
+
+func TestDecodeContext(t *testing.T) {
+	r, w := io.Pipe()
+	defer w.Close()
+	dec := NewDecoder(r)
+	go io.WriteString(w, "id: 1\ndata: par")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := dec.DecodeContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected: %s Got: %v", context.DeadlineExceeded, err)
+	}
+	go io.WriteString(w, "tial\n\n")
+	ev, err := dec.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Id() != "1" || ev.Data() != "partial" {
+		t.Errorf("Expected: 1 partial Got: %s %s", ev.Id(), ev.Data())
+	}
+}
+
+func TestDecoderLastEventID(t *testing.T) {
+	dec := NewDecoder(strings.NewReader("id: 1\ndata: a\n\ndata: b\n\nid\ndata: c\n\n" +
+		"id: 2\ndata: d\n\nid: 3\x004\ndata: e\n\nid:\ndata: f\n\n"))
+	if id := dec.LastEventID(); id != "" {
+		t.Errorf("Expected no last event id Got: %q", id)
+	}
+	// An omitted id keeps the previous one, and an empty id resets it
+	for _, want := range []string{"1", "1", "", "2", "2", ""} {
+		ev, err := dec.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id := dec.LastEventID(); id != want {
+			t.Errorf("Expected last event id after %s: %q Got: %q", ev.Data(), want, id)
+		}
+	}
+}
+
+func TestEncodeBinary(t *testing.T) {
+	buf := new(bytes.Buffer)
+	data := []byte{0, 1, '\n', '\r', 0xff}
+	if err := NewEncoder(buf).EncodeBinary("1", "proto", data); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewEncoder(buf).Encode(&testEvent{"2", "", "text"}); err != nil {
+		t.Fatal(err)
+	}
+	dec := NewDecoder(buf)
+	for _, want := range [][]byte{data, []byte("text")} {
+		ev, err := dec.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ev.(Binary).Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Expected: %v Got: %v", want, got)
+		}
+	}
+}
+
+func TestInvalidFields(t *testing.T) {
+	for _, ev := range []*testEvent{
+		{"1\nevent: injected", "", "data"},
+		{"1", "name\rdata: injected", "data"},
+	} {
+		buf := new(bytes.Buffer)
+		if err := NewEncoder(buf).Encode(ev); !errors.Is(err, ErrInvalidField) {
+			t.Errorf("Encoding %v Expected: %s Got: %v", *ev, ErrInvalidField, err)
+		}
+		if buf.Len() > 0 {
+			t.Errorf("Encoding %v Expected nothing written Got: %q", *ev, buf.String())
+		}
+	}
+	for _, name := range []string{"", "data: injected\nx", "x:y"} {
+		if err := NewEncoder(new(bytes.Buffer)).WriteField(name, "value"); !errors.Is(err, ErrInvalidField) {
+			t.Errorf("Writing field %q Expected: %s Got: %v", name, ErrInvalidField, err)
+		}
+	}
+}
+
+// Writes its data a byte at a time, so that line breaks are split across writes
+type trickleEvent struct {
+	testEvent
+}
+
+func (e *trickleEvent) WriteData(w io.Writer) error {
+	for i := 0; i < len(e.data); i++ {
+		if _, err := io.WriteString(w, e.data[i:i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestBytesEvent(t *testing.T) {
+	for _, tt := range encoderTests {
+		for _, ev := range []Event{BytesEvent(tt.event.id, tt.event.event, []byte(tt.event.data)), &trickleEvent{*tt.event}} {
+			buf := new(bytes.Buffer)
+			if err := NewEncoder(buf).Encode(ev); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tt.output {
+				t.Errorf("Expected: %q Got: %q", tt.output, buf.String())
+			}
+		}
+	}
+	for data, want := range map[string]string{
+		"":                "id: 1\n\n",
+		"a\r\nb\rc\r\r\n": "id: 1\ndata: a\ndata: b\ndata: c\ndata: \ndata: \n\n",
+	} {
+		for _, ev := range []Event{BytesEvent("1", "", []byte(data)), &trickleEvent{testEvent{"1", "", data}}} {
+			buf := new(bytes.Buffer)
+			if err := NewEncoder(buf).Encode(ev); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != want {
+				t.Errorf("Expected: %q Got: %q", want, buf.String())
+			}
+		}
+	}
+}
+
+func BenchmarkEncodeBytes(b *testing.B) {
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 16)
+	b.Run("string", func(b *testing.B) {
+		enc := NewEncoder(io.Discard)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			enc.Encode(&testEvent{"1", "", string(payload)})
+		}
+	})
+	b.Run("bytes", func(b *testing.B) {
+		enc := NewEncoder(io.Discard)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			enc.Encode(BytesEvent("1", "", payload))
+		}
+	})
+}
+
+func TestMaxLineLength(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		max    int
+		encode func(enc *Encoder) error
+		// What's written, or empty if it's expected to return ErrLineTooLong
+		want string
+	}{
+		{"data line too long", 20, func(enc *Encoder) error {
+			return enc.Encode(&testEvent{"1", "", "fits\nthis line is far too long"})
+		}, ""},
+		{"DataWriter too long", 20, func(enc *Encoder) error {
+			return enc.Encode(BytesEvent("1", "", []byte("this line is far too long")))
+		}, ""},
+		{"binary too long", 20, func(enc *Encoder) error {
+			return enc.EncodeBinary("1", "", bytes.Repeat([]byte{0xff}, 20))
+		}, ""},
+		// "data: " and fourteen bytes just fit
+		{"data fits", 20, func(enc *Encoder) error {
+			return enc.Encode(&testEvent{"1", "", "fourteen bytes\nfits"})
+		}, "id: 1\ndata: fourteen bytes\ndata: fits\n\n"},
+		// Neither the empty event name nor the retry field is written, and ResetId is written as a bare id
+		{"omitted fields", 2, func(enc *Encoder) error {
+			return enc.Encode(&testEvent{ResetId, "", ""})
+		}, "id\n\n"},
+		{"binary without a name", 16, func(enc *Encoder) error {
+			return enc.EncodeBinary("", "", []byte("ab"))
+		}, "encoding: base64\ndata: YWI=\n\n"},
+		{"comment fits", 10, func(enc *Encoder) error {
+			return enc.Comment("12345678")
+		}, ": 12345678\n"},
+		{"comment too long", 10, func(enc *Encoder) error {
+			return enc.Comment("fits\nthis line is too long")
+		}, ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			enc := NewEncoder(buf)
+			enc.MaxLineLength = test.max
+			err := test.encode(enc)
+			if len(test.want) == 0 && !errors.Is(err, ErrLineTooLong) {
+				t.Errorf("Expected: %s Got: %v", ErrLineTooLong, err)
+			} else if len(test.want) > 0 && err != nil {
+				t.Error(err)
+			}
+			if buf.String() != test.want {
+				t.Errorf("Expected: %q Got: %q", test.want, buf.String())
+			}
+		})
+	}
+}
+
+func TestEncoderBatch(t *testing.T) {
+	rec := httptest.NewRecorder()
+	enc := NewEncoder(rec)
+	enc.Batch()
+	enc.Encode(&testEvent{"1", "", "first"})
+	enc.Encode(&testEvent{"2", "", "second"})
+	if rec.Body.Len() > 0 || rec.Flushed {
+		t.Fatalf("Expected nothing to be written before Flush Got: %q", rec.Body.String())
+	}
+	if err := enc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "id: 1\ndata: first\n\nid: 2\ndata: second\n\n"; rec.Body.String() != want || !rec.Flushed {
+		t.Errorf("Expected: %q flushed Got: %q flushed: %v", want, rec.Body.String(), rec.Flushed)
+	}
+	// The batch has ended
+	enc.Encode(&testEvent{"3", "", "third"})
+	if !strings.HasSuffix(rec.Body.String(), "id: 3\ndata: third\n\n") {
+		t.Errorf("Expected the event to be written straight away Got: %q", rec.Body.String())
+	}
+}
+
+func BenchmarkReplayFlush(b *testing.B) {
+	backlog := make([]Event, 1000)
+	for i := range backlog {
+		backlog[i] = &testEvent{strconv.Itoa(i), "", "replayed event"}
+	}
+	for _, batched := range []bool{false, true} {
+		name := "per-event"
+		if batched {
+			name = "batched"
+		}
+		b.Run(name, func(b *testing.B) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				enc := NewEncoder(w)
+				if batched {
+					enc.Batch()
+				}
+				for _, ev := range backlog {
+					enc.Encode(ev)
+					if !batched {
+						enc.Flush()
+					}
+				}
+				enc.Flush()
+			}))
+			defer ts.Close()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resp, err := http.Get(ts.URL)
+				if err != nil {
+					b.Fatal(err)
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		})
+	}
+}
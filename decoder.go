@@ -2,48 +2,217 @@ package eventsource
 
 import (
 	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type publication struct {
 	id, event, data string
-	retry           int64
+	retry           time.Duration
+	// Set to "base64" by the field written by Encoder.EncodeBinary
+	encoding string
 }
 
-func (s *publication) Id() string    { return s.id }
-func (s *publication) Event() string { return s.event }
-func (s *publication) Data() string  { return s.data }
-func (s *publication) Retry() int64  { return s.retry }
+func (s *publication) Id() string           { return s.id }
+func (s *publication) Event() string        { return s.event }
+func (s *publication) Data() string         { return s.data }
+func (s *publication) Retry() time.Duration { return s.retry }
 
-type decoder struct {
-	*bufio.Reader
+// Returns the data, decoded from base64 if the event was written by Encoder.EncodeBinary.
+func (s *publication) Bytes() ([]byte, error) {
+	if s.encoding == "base64" {
+		return base64.StdEncoding.DecodeString(s.data)
+	}
+	return []byte(s.data), nil
+}
+
+// String returns the event as an Encoder writes it, as it was sent over the wire, for logging and test failures.
+func (s *publication) String() string {
+	var buf strings.Builder
+	if err := NewEncoder(&buf).Encode(s); err != nil {
+		return fmt.Sprintf("invalid event id: %q event: %q data: %q", s.id, s.event, s.data)
+	}
+	return buf.String()
+}
+
+// Change the name of the event. Browsers dispatch events with an empty name, for which no event field is
+// sent, as "message" events.
+func (s *publication) SetEvent(name string) { s.event = name }
+
+// The default limit on the size of a single event, including its field names and any comments within it
+const DefaultMaxEventSize = 1 << 20
+
+// Returned by Decode if an event is larger than the Decoder's MaxEventSize.
+// The rest of the stream can't be decoded.
+var ErrEventTooLarge = errors.New("Eventsource: Decode: event too large")
+
+// Returned by Decode when the stream ends partway through an event, which is discarded, wrapping
+// io.ErrUnexpectedEOF so that errors.Is can check for it. The connection was most likely lost, so a client can
+// reconnect and resume from the last event it received whole.
+type MalformedEventError struct {
+	Err error
+}
+
+func (e *MalformedEventError) Error() string {
+	return "Eventsource: Decode: malformed event: " + e.Err.Error()
+}
+
+func (e *MalformedEventError) Unwrap() error {
+	return e.Err
+}
+
+// A Decoder reads Events from a stream in the Server-Sent Events format.
+type Decoder struct {
+	r *bufio.Reader
+	// If set, the text of each comment is sent to Comments as it is read,
+	// for instance to observe keepalives. Decode blocks until it's received.
+	Comments chan string
+	// The largest event which will be decoded, so that a stream which never
+	// ends an event can't exhaust memory. Defaults to DefaultMaxEventSize.
+	MaxEventSize int
+	handlers     map[string]func(Event)
+	// The result of a decode abandoned by DecodeContext, once it completes
+	pending chan decoded
+	// The last event id as of the last event returned, and as it's being read
+	lastEventId, idBuffer string
 }
 
-func newDecoder(r io.Reader) *decoder {
-	dec := &decoder{bufio.NewReader(newNormaliser(r))}
+type decoded struct {
+	ev          Event
+	err         error
+	lastEventId string
+}
+
+// Create a Decoder reading from r
+func NewDecoder(r io.Reader) *Decoder {
+	dec := &Decoder{r: bufio.NewReader(newNormaliser(r))}
 	return dec
 }
 
 // Decode reads the next Event from a stream (and will block until one
-// comes in).
+// comes in). The Event implements Retrier, reporting the retry field if
+// the server sent one. Comments are skipped, as are blank lines which
+// don't end an event.
 // Graceful disconnects (between events) are indicated by an io.EOF error.
-// Any error occuring mid-event is considered non-graceful and will
-// show up as some other error (most likely io.ErrUnexpectedEOF).
-func (dec *decoder) Decode() (Event, error) {
+// A stream ending mid-event is considered non-graceful and shows up as a
+// *MalformedEventError, while any other error reading the stream is
+// returned as it is.
+func (dec *Decoder) Decode() (Event, error) {
+	if dec.pending != nil {
+		d := <-dec.pending
+		dec.pending = nil
+		return dec.result(d)
+	}
+	return dec.result(dec.next())
+}
+
+// LastEventID returns the last event id as of the last Event returned by Decode, which a client sends when
+// reconnecting to resume the stream, for instance after being persisted across restarts. As in browsers, an
+// event without an id field leaves it unchanged, an empty id field resets it to an empty string, and an id
+// containing a NULL character is ignored.
+func (dec *Decoder) LastEventID() string {
+	return dec.lastEventId
+}
+
+func (dec *Decoder) result(d decoded) (Event, error) {
+	if d.err == nil {
+		dec.lastEventId = d.lastEventId
+	}
+	return d.ev, d.err
+}
 
+// DecodeContext is like Decode, but gives up waiting for the next Event when
+// the context is done, returning an error wrapping the context's error which
+// can be checked for with errors.Is. The Event is still read in the
+// background, and is returned by the next call to Decode or DecodeContext.
+func (dec *Decoder) DecodeContext(ctx context.Context) (Event, error) {
+	if dec.pending == nil {
+		pending := make(chan decoded, 1)
+		dec.pending = pending
+		go func() {
+			pending <- dec.next()
+		}()
+	}
+	select {
+	case d := <-dec.pending:
+		dec.pending = nil
+		return dec.result(d)
+	case <-ctx.Done():
+		return nil, fmt.Errorf("Eventsource: Decode: %w", ctx.Err())
+	}
+}
+
+func (dec *Decoder) next() decoded {
+	for {
+		pub, err := dec.decode()
+		if err != nil {
+			return decoded{err: err}
+		}
+		if pub != nil {
+			return decoded{pub, nil, dec.idBuffer}
+		}
+	}
+}
+
+// On registers fn to be called by Run for each event with the specified
+// name, replacing any function already registered for it. As in browsers,
+// events without a name are dispatched as "message" events.
+func (dec *Decoder) On(name string, fn func(Event)) {
+	if dec.handlers == nil {
+		dec.handlers = make(map[string]func(Event))
+	}
+	dec.handlers[name] = fn
+}
+
+// Run decodes events until the stream ends, calling the function
+// registered with On for each one's name. Events with no function
+// registered are discarded. Returns nil if the stream ended gracefully,
+// otherwise the error from Decode.
+func (dec *Decoder) Run() error {
+	for {
+		ev, err := dec.Decode()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := ev.Event()
+		if len(name) == 0 {
+			name = "message"
+		}
+		if fn, ok := dec.handlers[name]; ok {
+			fn(ev)
+		}
+	}
+}
+
+// Returns a nil publication if no fields were read before the blank line
+func (dec *Decoder) decode() (*publication, error) {
 	// peek ahead before we start a new event so we can return EOFs
-	_, err := dec.Peek(1)
+	_, err := dec.r.Peek(1)
 	if err == io.ErrUnexpectedEOF {
 		err = io.EOF
 	}
 	if err != nil {
 		return nil, err
 	}
-	pub := new(publication)
+	var pub *publication
+	size := 0
 	for {
-		line, err := dec.ReadString('\n')
+		line, err := dec.readLine(&size)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if pub == nil && len(line) == 0 {
+				return nil, io.EOF
+			}
+			return nil, &MalformedEventError{io.ErrUnexpectedEOF}
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -52,8 +221,14 @@ func (dec *decoder) Decode() (Event, error) {
 		}
 		line = strings.TrimSuffix(line, "\n")
 		if strings.HasPrefix(line, ":") {
+			if dec.Comments != nil {
+				dec.Comments <- strings.TrimPrefix(line[1:], " ")
+			}
 			continue
 		}
+		if pub == nil {
+			pub = new(publication)
+		}
 		sections := strings.SplitN(line, ":", 2)
 		field, value := sections[0], ""
 		if len(sections) == 2 {
@@ -65,11 +240,44 @@ func (dec *decoder) Decode() (Event, error) {
 		case "data":
 			pub.data += value + "\n"
 		case "id":
+			if strings.ContainsRune(value, 0) {
+				continue
+			}
+			dec.idBuffer = value
 			pub.id = value
+			if len(value) == 0 {
+				pub.id = ResetId
+			}
+		case "encoding":
+			pub.encoding = value
 		case "retry":
-			pub.retry, _ = strconv.ParseInt(value, 10, 64)
+			// Values which aren't entirely digits are ignored, as browsers do
+			if retry, err := strconv.ParseUint(value, 10, 63); err == nil {
+				pub.retry = time.Duration(retry) * time.Millisecond
+			}
 		}
 	}
-	pub.data = strings.TrimSuffix(pub.data, "\n")
+	if pub != nil {
+		pub.data = strings.TrimSuffix(pub.data, "\n")
+	}
 	return pub, nil
 }
+
+// Reads up to and including the next newline, adding its length to size
+func (dec *Decoder) readLine(size *int) (string, error) {
+	limit := dec.MaxEventSize
+	if limit <= 0 {
+		limit = DefaultMaxEventSize
+	}
+	var line []byte
+	for {
+		chunk, err := dec.r.ReadSlice('\n')
+		if *size += len(chunk); *size > limit {
+			return "", ErrEventTooLarge
+		}
+		line = append(line, chunk...)
+		if err != bufio.ErrBufferFull {
+			return string(line), err
+		}
+	}
+}
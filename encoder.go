@@ -1,39 +1,164 @@
 package eventsource
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var (
 	encFields = []struct {
-		prefix string
-		value  func(Event) string
+		name  string
+		value func(Event) string
 	}{
-		{"id: ", Event.Id},
-		{"event: ", Event.Event},
-		{"data: ", Event.Data},
+		{"id", Event.Id},
+		{"event", Event.Event},
+		{"retry", retry},
+		{"data", Event.Data},
 	}
+	lineEndings = strings.NewReplacer("\r\n", "\n", "\r", "\n")
 )
 
-type encoder struct {
+// Returned, wrapped with the details, by the Encoder's methods when a field can't be written without corrupting
+// the stream, as its name contains a line break or colon, or its value contains a line break when it's an id or
+// event name, which unlike data can't span lines. Nothing of the event is written, so the stream can carry on.
+var ErrInvalidField = errors.New("Eventsource: Encode: invalid field")
+
+// Returned, wrapped with the details, by the Encoder's methods when a line of a field or comment would be longer
+// than the Encoder's MaxLineLength. Nothing of the event or comment is written, so the stream can carry on. Splitting the line across
+// several data fields would change the data, as clients join them with newlines, so the producer must split the
+// data across several events itself, or send it by some other means.
+var ErrLineTooLong = errors.New("Eventsource: Encode: line too long")
+
+func validField(name, value string) error {
+	if len(name) == 0 || strings.ContainsAny(name, "\r\n:") {
+		return fmt.Errorf("%w name %q", ErrInvalidField, name)
+	}
+	if (name == "id" || name == "event") && strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("%w %s %q", ErrInvalidField, name, value)
+	}
+	return nil
+}
+
+func retry(ev Event) string {
+	if r, ok := ev.(Retrier); ok && r.Retry() > 0 {
+		return strconv.FormatInt(int64(r.Retry()/time.Millisecond), 10)
+	}
+	return ""
+}
+
+// An Encoder writes Events to a stream in the Server-Sent Events format, the
+// same as the Server sends them, for instance to a file or a test's buffer.
+type Encoder struct {
 	w io.Writer
+	// The writer passed to NewEncoder, which w buffers while batching
+	dst   io.Writer
+	batch *bufio.Writer
+	// Reused for each DataWriter, so that writing its data doesn't allocate
+	lines dataLines
+	// If non-zero, the longest line, not counting its newline, which will be written for a field or comment, for
+	// streams passing through proxies which drop or break up longer lines. Fields and comments with longer lines
+	// return ErrLineTooLong. Defaults to unlimited.
+	MaxLineLength int
+}
+
+// Returns an error if the field can't be written as it is
+func (enc *Encoder) check(name, value string) error {
+	if err := validField(name, value); err != nil || enc.MaxLineLength <= 0 {
+		return err
+	}
+	if len(value) == 0 {
+		if len(name) > enc.MaxLineLength {
+			return fmt.Errorf("%w: %s field of %d bytes", ErrLineTooLong, name, len(name))
+		}
+		return nil
+	}
+	for _, line := range strings.Split(lineEndings.Replace(value), "\n") {
+		if n := len(name) + len(": ") + len(line); n > enc.MaxLineLength {
+			return fmt.Errorf("%w: %s field of %d bytes", ErrLineTooLong, name, n)
+		}
+	}
+	return nil
+}
+
+// Create an Encoder writing to w
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w, dst: w}
 }
 
-func newEncoder(w io.Writer) *encoder {
-	return &encoder{w: w}
+// Batch buffers whatever is written from now on until Flush is called, so that a burst of events, such as
+// those replayed to a client catching up, reaches the underlying writer in a few large writes and a single flush
+// rather than one for each event.
+func (enc *Encoder) Batch() {
+	if enc.batch == nil {
+		enc.batch = bufio.NewWriterSize(enc.dst, 32<<10)
+		enc.w = enc.batch
+	}
 }
 
-func (enc *encoder) Encode(ev Event) (err error) {
-	for _, field := range encFields {
-		prefix, value := field.prefix, field.value(ev)
+// Flush writes out anything buffered since Batch was called, ending the batch, then flushes the underlying
+// writer if it supports it.
+func (enc *Encoder) Flush() (err error) {
+	if enc.batch != nil {
+		err = enc.batch.Flush()
+		enc.w, enc.batch = enc.dst, nil
+		if err != nil {
+			return fmt.Errorf("Eventsource: Flush: %s", err)
+		}
+	}
+	if flusher, ok := enc.dst.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return
+}
+
+// Encode writes ev, followed by the blank line which ends it. Fields with an
+// empty value are omitted, and a Retrier's delay is sent as a retry field.
+// A DataWriter's data is written straight from WriteData, unless there's a
+// MaxLineLength, when its Data has to be checked first.
+func (enc *Encoder) Encode(ev Event) (err error) {
+	writer, direct := ev.(DataWriter)
+	direct = direct && enc.MaxLineLength <= 0
+	values := make([]string, len(encFields))
+	for i, field := range encFields {
+		if direct && field.name == "data" {
+			continue
+		}
+		values[i] = field.value(ev)
+		// Only what will be written is checked
+		value := values[i]
 		if len(value) == 0 {
 			continue
 		}
-		value = strings.Replace(value, "\n", "\n"+prefix, -1)
-		if _, err = io.WriteString(enc.w, prefix+value+"\n"); err != nil {
-			err = fmt.Errorf("Eventsource: Encode: %s", err)
+		if field.name == "id" && value == ResetId {
+			value = ""
+		}
+		if err = enc.check(field.name, value); err != nil {
+			return
+		}
+	}
+	for i, field := range encFields {
+		if direct && field.name == "data" {
+			if err = enc.writeData(writer); err != nil {
+				return
+			}
+			continue
+		}
+		value := values[i]
+		if len(value) == 0 {
+			continue
+		}
+		if field.name == "id" && value == ResetId {
+			value = ""
+		}
+		if err = enc.WriteField(field.name, value); err != nil {
 			return
 		}
 	}
@@ -42,3 +167,137 @@ func (enc *encoder) Encode(ev Event) (err error) {
 	}
 	return
 }
+
+// EncodeBinary writes an event whose data is arbitrary bytes, such as a protobuf message, which can't be sent as
+// text. The data is base64 encoded, and the event has an "encoding: base64" field so that a Decoder can reverse it
+// through the event's Bytes method. Other clients, such as browsers, must know to expect base64 data themselves.
+func (enc *Encoder) EncodeBinary(id, name string, data []byte) (err error) {
+	fields := [][2]string{
+		{"id", id},
+		{"event", name},
+		{"encoding", "base64"},
+		{"data", base64.StdEncoding.EncodeToString(data)},
+	}
+	for _, field := range fields {
+		if len(field[1]) == 0 {
+			continue
+		}
+		if err = enc.check(field[0], field[1]); err != nil {
+			return
+		}
+	}
+	for _, field := range fields {
+		if len(field[1]) == 0 {
+			continue
+		}
+		if err = enc.WriteField(field[0], field[1]); err != nil {
+			return
+		}
+	}
+	if _, err = io.WriteString(enc.w, "\n"); err != nil {
+		err = fmt.Errorf("Eventsource: Encode: %s", err)
+	}
+	return
+}
+
+// WriteField writes a single field of an event, such as one the Event
+// interface doesn't cover. Browsers ignore fields with names they don't
+// recognise, so custom fields are only of use to custom clients. The event
+// isn't sent until it is ended by writing a blank line to the underlying
+// writer. An empty value is written as the field name alone.
+func (enc *Encoder) WriteField(name, value string) (err error) {
+	if err = enc.check(name, value); err != nil {
+		return
+	}
+	if len(value) == 0 {
+		if _, err = io.WriteString(enc.w, name+"\n"); err != nil {
+			err = fmt.Errorf("Eventsource: Encode: %s", err)
+		}
+		return
+	}
+	// Each line of a multi-line value must be sent as a separate field,
+	// which the client joins back together with newlines
+	for _, line := range strings.Split(lineEndings.Replace(value), "\n") {
+		if _, err = io.WriteString(enc.w, name+": "+line+"\n"); err != nil {
+			err = fmt.Errorf("Eventsource: Encode: %s", err)
+			return
+		}
+	}
+	return
+}
+
+func (enc *Encoder) writeData(writer DataWriter) error {
+	enc.lines = dataLines{w: enc.w}
+	err := writer.WriteData(&enc.lines)
+	if err == nil && enc.lines.started {
+		_, err = io.WriteString(enc.w, "\n")
+	}
+	enc.lines.w = nil
+	if err != nil {
+		return fmt.Errorf("Eventsource: Encode: %s", err)
+	}
+	return nil
+}
+
+// Writes what's written to it as data fields, starting a new field at each
+// line break as WriteField does, without copying it. Nothing is written for
+// empty data, so that the field is omitted as it is for an empty Data.
+type dataLines struct {
+	w       io.Writer
+	started bool
+	// Whether the last byte written was a carriage return, in which case a
+	// newline following it is part of the same line break
+	cr bool
+}
+
+func (d *dataLines) Write(p []byte) (n int, err error) {
+	if len(p) > 0 && !d.started {
+		if _, err = io.WriteString(d.w, "data: "); err != nil {
+			return
+		}
+		d.started = true
+	}
+	for len(p) > 0 {
+		if d.cr && p[0] == '\n' {
+			d.cr = false
+			p = p[1:]
+			n++
+			continue
+		}
+		i := bytes.IndexAny(p, "\r\n")
+		if i < 0 {
+			d.cr = false
+			m, err := d.w.Write(p)
+			return n + m, err
+		}
+		if _, err = d.w.Write(p[:i]); err != nil {
+			return
+		}
+		if _, err = io.WriteString(d.w, "\ndata: "); err != nil {
+			return
+		}
+		d.cr = p[i] == '\r'
+		n += i + 1
+		p = p[i+1:]
+	}
+	return
+}
+
+// Comment writes text as a comment, which clients will ignore, and flushes
+// the underlying writer like Flush. Each line of text is written as a
+// separate comment so that none of it can be mistaken for a field.
+func (enc *Encoder) Comment(text string) (err error) {
+	lines := strings.Split(lineEndings.Replace(text), "\n")
+	for _, line := range lines {
+		if n := len(": ") + len(line); enc.MaxLineLength > 0 && n > enc.MaxLineLength {
+			return fmt.Errorf("%w: comment of %d bytes", ErrLineTooLong, n)
+		}
+	}
+	for _, line := range lines {
+		if _, err = io.WriteString(enc.w, ": "+line+"\n"); err != nil {
+			err = fmt.Errorf("Eventsource: Comment: %s", err)
+			return
+		}
+	}
+	return enc.Flush()
+}
@@ -0,0 +1,55 @@
+package eventsource
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// Create an Event whose data is v encoded as JSON. Its name can be changed later through its
+// SetEvent(name string) method.
+func JSONEvent(id, name string, v interface{}) (Event, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return &publication{id: id, event: name, data: string(data)}, nil
+}
+
+// EventsEqual reports whether two events are the same as far as this package is concerned: they have the same
+// id, name and data, and the same retry delay, taking an event which isn't a Retrier to have none. Other
+// methods either event has, such as Bytes, are ignored.
+func EventsEqual(a, b Event) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Id() == b.Id() && a.Event() == b.Event() && a.Data() == b.Data() && retryDelay(a) == retryDelay(b)
+}
+
+func retryDelay(ev Event) time.Duration {
+	if r, ok := ev.(Retrier); ok {
+		return r.Retry()
+	}
+	return 0
+}
+
+// Create an Event whose data is the bytes of data, which are written to clients as they are rather than being
+// converted to a string first, for producers whose payloads are already bytes. data must not be changed once the
+// event has been published.
+func BytesEvent(id, name string, data []byte) Event {
+	return &bytesEvent{id: id, event: name, data: data}
+}
+
+type bytesEvent struct {
+	id, event string
+	data      []byte
+}
+
+func (e *bytesEvent) Id() string    { return e.id }
+func (e *bytesEvent) Event() string { return e.event }
+func (e *bytesEvent) Data() string  { return string(e.data) }
+
+func (e *bytesEvent) WriteData(w io.Writer) error {
+	_, err := w.Write(e.data)
+	return err
+}
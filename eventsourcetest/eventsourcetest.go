@@ -0,0 +1,35 @@
+// Package eventsourcetest provides helpers for testing code which uses the eventsource package, kept apart so
+// that programs using eventsource don't link net/http/httptest.
+package eventsourcetest
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/donovanhide/eventsource"
+)
+
+// NewTestStream serves h from a local test server and returns a Stream connected to it, for end to end tests of
+// code using both the server and client. The handler has subscribed by the time the Stream is returned, so events
+// published afterwards will be received. The test server is shut down when the Stream is closed, which is
+// noticed through its States, so they aren't available to the caller. It panics if the Stream can't connect.
+func NewTestStream(h http.HandlerFunc) *eventsource.Stream {
+	ts := httptest.NewServer(h)
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		ts.Close()
+		panic("Eventsource: NewTestStream: " + err.Error())
+	}
+	stream := eventsource.NewStream("", http.DefaultClient, req)
+	stream.States = make(chan eventsource.StateChange, 1)
+	go func() {
+		// Closed is the last change before States is closed
+		for range stream.States {
+		}
+		ts.Close()
+	}()
+	if err := stream.Connect(); err != nil {
+		panic("Eventsource: NewTestStream: " + err.Error())
+	}
+	return stream
+}
@@ -0,0 +1,33 @@
+package eventsourcetest_test
+
+import (
+	"fmt"
+
+	"github.com/donovanhide/eventsource"
+	"github.com/donovanhide/eventsource/eventsourcetest"
+)
+
+type Message struct {
+	id, data string
+}
+
+func (m Message) Id() string    { return m.id }
+func (m Message) Event() string { return "" }
+func (m Message) Data() string  { return m.data }
+
+func ExampleNewTestStream() {
+	srv := eventsource.NewServer()
+	defer srv.Close()
+	stream := eventsourcetest.NewTestStream(srv.Handler("messages"))
+	defer stream.Close()
+	srv.Publish([]string{"messages"}, Message{"1", "hello"})
+	srv.Publish([]string{"messages"}, Message{"2", "world"})
+	for i := 0; i < 2; i++ {
+		ev := <-stream.Events
+		fmt.Println(ev.Id(), ev.Data())
+	}
+
+	// Output:
+	// 1 hello
+	// 2 world
+}
@@ -0,0 +1,24 @@
+package eventsource_test
+
+import (
+	"github.com/donovanhide/eventsource"
+	"os"
+)
+
+type Message struct {
+	id, data string
+}
+
+func (m Message) Id() string    { return m.id }
+func (m Message) Event() string { return "" }
+func (m Message) Data() string  { return m.data }
+
+func ExampleEncoder() {
+	enc := eventsource.NewEncoder(os.Stdout)
+	enc.Encode(Message{"1", "first line\nsecond line"})
+
+	// Output:
+	// id: 1
+	// data: first line
+	// data: second line
+}
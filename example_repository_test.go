@@ -24,10 +24,9 @@ var articles = []NewsArticle{
 }
 
 func buildRepo(srv *eventsource.Server) {
-	repo := eventsource.NewSliceRepository()
-	srv.Register("articles", repo)
+	// The repository stores the events as they're published
+	srv.Register("articles", eventsource.NewSliceRepository())
 	for i := range articles {
-		repo.Add("articles", &articles[i])
 		srv.Publish([]string{"articles"}, &articles[i])
 	}
 }
@@ -52,12 +51,12 @@ func ExampleRepository() {
 		ev := <-stream.Events
 		fmt.Println(ev.Id(), ev.Event(), ev.Data())
 	}
-	stream, err = eventsource.Subscribe("http://127.0.0.1:8080/articles", "1")
+	stream, err = eventsource.Subscribe("http://127.0.0.1:8080/articles", "2")
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
-	// This will replay the events in order of id
+	// This will replay the events from the one with id 2 onwards, in the order they were published
 	for i := 0; i < 3; i++ {
 		ev := <-stream.Events
 		fmt.Println(ev.Id(), ev.Event(), ev.Data())
@@ -66,7 +65,7 @@ func ExampleRepository() {
 	// 2 News Article {"Title":"Governments struggle to control global price of gas","Content":"Hot air...."}
 	// 1 News Article {"Title":"Tomorrow is another day","Content":"And so is the day after."}
 	// 3 News Article {"Title":"News for news' sake","Content":"Nothing has happened."}
-	// 1 News Article {"Title":"Tomorrow is another day","Content":"And so is the day after."}
 	// 2 News Article {"Title":"Governments struggle to control global price of gas","Content":"Hot air...."}
+	// 1 News Article {"Title":"Tomorrow is another day","Content":"And so is the day after."}
 	// 3 News Article {"Title":"News for news' sake","Content":"Nothing has happened."}
 }
@@ -0,0 +1,160 @@
+package eventsource
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Repository which appends the events for each channel to a file in a directory, so that they can still be
+// replayed after a restart. The files use the same format as the event stream.
+type FileRepository struct {
+	dir  string
+	lock sync.RWMutex
+}
+
+// Create a repository storing its files in dir, which must already exist.
+func NewFileRepository(dir string) *FileRepository {
+	return &FileRepository{dir: dir}
+}
+
+func (repo *FileRepository) path(channel string) string {
+	return filepath.Join(repo.dir, url.PathEscape(channel)+".events")
+}
+
+// Replays the events which followed the specified id, by reading the channel's file from the start.
+// If the id is empty all the events in the file are replayed, as they are if it's unknown, following UnknownId.
+// If the file can't be read to the end, the events read are followed by a ReplayError.
+func (repo *FileRepository) Replay(channel, id string) (out chan Event) {
+	out = make(chan Event)
+	repo.lock.RLock()
+	f, err := os.Open(repo.path(channel))
+	repo.lock.RUnlock()
+	if err != nil {
+		go func() {
+			defer close(out)
+			if len(id) > 0 {
+				out <- UnknownId
+			}
+		}()
+		return
+	}
+	go func() {
+		defer close(out)
+		defer f.Close()
+		var events []Event
+		var failed error
+		found := len(id) == 0
+		dec := NewDecoder(f)
+		for {
+			ev, err := dec.Decode()
+			if partial(err) {
+				// An event still being appended is left for the next replay
+				break
+			}
+			if err != nil {
+				failed = err
+				break
+			}
+			if len(id) > 0 && ev.Id() == id {
+				events, found = events[:0], true
+				continue
+			}
+			events = append(events, ev)
+		}
+		if !found {
+			out <- UnknownId
+		}
+		for _, ev := range events {
+			out <- ev
+		}
+		if failed != nil {
+			out <- &ReplayError{failed}
+		}
+	}()
+	return
+}
+
+// Reports whether decoding a file stopped at its end, including partway
+// through an event which was never finished
+func partial(err error) bool {
+	var malformed *MalformedEventError
+	return err == io.EOF || errors.As(err, &malformed)
+}
+
+// Append an event to the channel's file.
+func (repo *FileRepository) Add(channel string, event Event) error {
+	buf := new(bytes.Buffer)
+	if err := NewEncoder(buf).Encode(event); err != nil {
+		return err
+	}
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	f, err := os.OpenFile(repo.path(channel), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = buf.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Store appends an event published to a channel the repository is registered for, as Add does, returning
+// any error for the Server to report.
+func (repo *FileRepository) Store(channel string, event Event) error {
+	return repo.Add(channel, event)
+}
+
+// Rewrite the channel's file with only its most recent keep events. A keep of zero or less drops them all.
+func (repo *FileRepository) Compact(channel string, keep int) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	path := repo.path(channel)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var events []Event
+	dec := NewDecoder(f)
+	for {
+		ev, err := dec.Decode()
+		if partial(err) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		events = append(events, ev)
+	}
+	if keep <= 0 {
+		events = nil
+	} else if len(events) > keep {
+		events = events[len(events)-keep:]
+	}
+	tmp, err := os.CreateTemp(repo.dir, "compact-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	enc := NewEncoder(tmp)
+	for _, ev := range events {
+		if err = enc.Encode(ev); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -5,6 +5,12 @@
 // If the Repository interface is implemented on the server, events can be replayed in case of a network disconnection.
 package eventsource
 
+import (
+	"context"
+	"io"
+	"time"
+)
+
 // Any event received by the client or sent by the server will implement this interface
 type Event interface {
 	// Id is an identifier that can be used to allow a client to replay
@@ -17,9 +23,116 @@ type Event interface {
 	Data() string
 }
 
+// Return ResetId from Event.Id to send an empty id field, which clears the client's last event id so it won't
+// be sent when reconnecting. Returning an empty string omits the id field, leaving the client's last event id
+// unchanged. Decoded events with an empty id field also return ResetId.
+const ResetId = "\x00"
+
+// Events which also implement this interface tell the client how long to wait before reconnecting
+// if the connection is lost.
+type Retrier interface {
+	// The reconnection delay. Return zero if not required.
+	Retry() time.Duration
+}
+
+// Events returned by a Decoder also implement this interface, which returns their data as bytes, reversing the
+// base64 encoding of events written by Encoder.EncodeBinary.
+type Binary interface {
+	Bytes() ([]byte, error)
+}
+
+// Events which also implement this interface have their data written through WriteData rather than taken from
+// Data when they're encoded, by an Encoder or the Server's handlers, so that data held as bytes can be sent without
+// first being converted to a string. WriteData must write the same data as Data returns, which is still used where
+// the data is needed as a string, such as by WebSocketHandler. Line breaks in what's written are handled as they
+// are in Data.
+type DataWriter interface {
+	WriteData(w io.Writer) error
+}
+
 // If history is required, this interface will allow clients to reply previous events through the server.
 // Both methods can be called from different goroutines concurrently, so you must make sure they are go-routine safe.
 type Repository interface {
-	// Gets the Events which should follow on from the specified channel and event id.
+	// Gets the Events which should follow on from the specified channel and event id. Ids are scoped by channel,
+	// so different channels can use the same ids, and a repository shared between channels must keep them apart.
+	// An empty id, which is only requested when the Server's ReplayAll is set, means all of the channel's Events.
 	Replay(channel, id string) chan Event
 }
+
+// Repositories which also implement this interface have ReplayContext called in place of Replay, with the context
+// of the client's request, so that values it carries, such as the client's identity, can decide what history the
+// client may replay. The context is done once the client goes away, when replaying can stop. Existing
+// implementations are unaffected; to migrate one, move the body of Replay into ReplayContext and have Replay call
+// it with context.Background(), as Register still requires a Repository.
+type ContextRepository interface {
+	ReplayContext(ctx context.Context, channel, id string) <-chan Event
+}
+
+// Repositories which also implement this interface can replay events by when they were published, for clients
+// which keep track of when they last synced rather than of the last event they received. Clients without a last
+// event id pass the time in the Server's SinceParam query parameter, in milliseconds since the Unix epoch, and
+// ReplaySince is called in place of Replay with it, to replay the events published since then. A last event id
+// takes precedence, and repositories without this interface ignore the time.
+type TimeRepository interface {
+	ReplaySince(channel string, t time.Time) <-chan Event
+}
+
+// Repositories which also implement this interface are given each event published to a channel they're registered
+// for, including broadcasts and the PresenceChannel's announcements, with any id assigned by the Server's AutoID,
+// so that producers needn't add every event themselves. Store is called from the server's publishing goroutines, so
+// it must be quick and goroutine safe. Any error it returns is reported through the Server's OnError or ErrorLog.
+type Storer interface {
+	Store(channel string, ev Event) error
+}
+
+// The name of the event sent to a client when its last event id is unknown to the channel's Repository.
+// The event's data is the unknown id. The events which followed it may have been missed, so the client
+// should fetch the current state afresh.
+const ResyncEvent = "resync"
+
+// The name of the event sent to clients before they're disconnected by the Server's CloseChannel, Close or Shutdown,
+// if its SendEndOfStream is set, to tell them not to reconnect. A Stream passes the event on and then closes.
+// Browsers reconnect regardless, so pages must listen for the event and close their EventSource themselves.
+const EndOfStreamEvent = "end-of-stream"
+
+// A Repository can send UnknownId as the first event from Replay to report that the requested id is unknown,
+// for instance because it has expired, before replaying whatever it does still hold.
+// The server sends the client a ResyncEvent in its place.
+// Existing Repository implementations which never send it are unaffected.
+var UnknownId Event = &publication{event: "unknown id"}
+
+// A Repository can send a ReplayError as the last event from Replay when reading its history fails partway, for
+// instance because the file or database holding it can't be read, rather than just closing the channel as if
+// everything had been replayed. The server reports the error through its OnError or ErrorLog and sends the client
+// a ResyncEvent in its place, as the events which should have followed may be missing, before going on to live
+// events. Anything sent after it is ignored. Existing Repository implementations which never send it are unaffected.
+type ReplayError struct {
+	Err error
+}
+
+func (e *ReplayError) Id() string    { return "" }
+func (e *ReplayError) Event() string { return "" }
+func (e *ReplayError) Data() string  { return e.Error() }
+
+func (e *ReplayError) Error() string {
+	return "Eventsource: Replay: " + e.Err.Error()
+}
+
+func (e *ReplayError) Unwrap() error {
+	return e.Err
+}
+
+// Metrics receives counts of the server's activity, for instance to export to a monitoring system. Its methods are
+// called from the server's publishing goroutines and from handlers concurrently, so they must be quick and goroutine safe.
+type Metrics interface {
+	// An event was published to a channel, including by Broadcast.
+	EventPublished(channel string)
+	// An event was queued for a subscriber to the channel, or replayed to one.
+	EventDelivered(channel string)
+	// An event wasn't delivered to a subscriber to the channel, either because the subscriber wasn't keeping up
+	// or because a later event replaced it through the Server's CoalesceKey.
+	EventDropped(channel string)
+	// The number of subscribers to the channel went up or down by one.
+	SubscriberAdded(channel string)
+	SubscriberRemoved(channel string)
+}
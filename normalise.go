@@ -4,8 +4,8 @@ import (
 	"io"
 )
 
-// A reader which normalises line endings
-// "/r" and "/r/n" are converted to "/n"
+// A reader which normalises line endings, as CR, LF and CRLF all end a line.
+// "\r" and "\r\n" are converted to "\n", even when split between reads.
 type normaliser struct {
 	r        io.Reader
 	lastChar byte
@@ -17,19 +17,21 @@ func newNormaliser(r io.Reader) *normaliser {
 
 func (norm *normaliser) Read(p []byte) (n int, err error) {
 	n, err = norm.r.Read(p)
-	for i := 0; i < n; i++ {
+	// The LF of a CRLF is dropped, which may be the first byte of a read
+	// when the CR ended the previous one
+	j := 0
+	for _, c := range p[:n] {
+		last := norm.lastChar
+		norm.lastChar = c
 		switch {
-		case p[i] == '\n' && norm.lastChar == '\r':
-			copy(p[i:n], p[i+1:])
-			norm.lastChar = p[i]
-			n--
-			i--
-		case p[i] == '\r':
-			norm.lastChar = p[i]
-			p[i] = '\n'
-		default:
-			norm.lastChar = p[i]
+		case c == '\n' && last == '\r':
+			continue
+		case c == '\r':
+			c = '\n'
 		}
+		p[j] = c
+		j++
 	}
+	n = j
 	return
 }
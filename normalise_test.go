@@ -3,8 +3,10 @@ package eventsource
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 var (
@@ -15,7 +17,7 @@ var (
 	expected     = []string{"line1", "line2", "line3"}
 )
 
-func Testnormaliser(t *testing.T) {
+func TestNormaliser(t *testing.T) {
 	for i, first := range endings {
 		for j, second := range endings {
 			for k, suffix := range suffixes {
@@ -40,3 +42,65 @@ func Testnormaliser(t *testing.T) {
 		}
 	}
 }
+
+// Returns each chunk from a separate read, leaving CRs in the rest of the
+// buffer to catch any reading past the end of what was read
+type chunkReader struct {
+	chunks []string
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if len(c.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, c.chunks[0])
+	c.chunks[0] = c.chunks[0][n:]
+	if len(c.chunks[0]) == 0 {
+		c.chunks = c.chunks[1:]
+	}
+	for i := n; i < len(p); i++ {
+		p[i] = '\r'
+	}
+	return n, nil
+}
+
+func TestNormaliserChunks(t *testing.T) {
+	for _, chunks := range [][]string{
+		{"a\r", "\nb\r\n"},
+		{"a\r\n", "\nb\n"},
+		{"a\r\n", "\r", "\n"},
+		{"a", "\r", "\r", "\n", "\n"},
+	} {
+		output, err := io.ReadAll(newNormaliser(&chunkReader{append([]string(nil), chunks...)}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(strings.Join(chunks, ""))
+		if string(output) != want {
+			t.Errorf("Using %q Expected: %q Got: %q", chunks, want, output)
+		}
+	}
+}
+
+func TestDecodeLineEndings(t *testing.T) {
+	stream := "id: 1\nevent: first\ndata: a\ndata: b\n\nid: 2\ndata: c\n\n"
+	for _, ending := range endings {
+		input := strings.Replace(stream, "\n", ending, -1)
+		// Reading a byte at a time splits each CRLF between reads
+		for _, r := range []io.Reader{strings.NewReader(input), iotest.OneByteReader(strings.NewReader(input))} {
+			dec := NewDecoder(r)
+			for _, want := range []testEvent{{"1", "first", "a\nb"}, {"2", "", "c"}} {
+				ev, err := dec.Decode()
+				if err != nil {
+					t.Fatalf("Using %q: %s", ending, err)
+				}
+				if ev.Id() != want.id || ev.Event() != want.event || ev.Data() != want.data {
+					t.Errorf("Using %q Expected: %v Got: %s %s %q", ending, want, ev.Id(), ev.Event(), ev.Data())
+				}
+			}
+			if _, err := dec.Decode(); err != io.EOF {
+				t.Errorf("Using %q Expected EOF Got: %v", ending, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package eventsource
+
+import (
+	"sync"
+	"time"
+)
+
+// A token bucket, holding up to a second's worth of tokens
+type bucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate float64, now time.Time) *bucket {
+	return &bucket{rate: rate, tokens: burst(rate), last: now}
+}
+
+// At least one event can always be sent, however low the rate
+func burst(rate float64) float64 {
+	if rate < 1 {
+		return 1
+	}
+	return rate
+}
+
+// Returns how long to wait before a token will be available, taking it if
+// one is available now
+func (b *bucket) take(now time.Time) time.Duration {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	b.last = now
+	if max := burst(b.rate); b.tokens > max {
+		b.tokens = max
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Reports whether the bucket has filled up again, when it's no different from a new one
+func (b *bucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= burst(b.rate)
+}
+
+// Limits how often each client can subscribe. It's kept apart from the shards
+// so that subscribing in a tight loop doesn't hold up publishing.
+type clientLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+// Returns how long the client must wait before subscribing, or zero if it can
+// subscribe now
+func (l *clientLimiter) take(client string, rate float64, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*bucket)
+	}
+	// Full buckets are dropped now and then, so that the map doesn't keep
+	// every client which has ever subscribed
+	if now.Sub(l.swept) > time.Minute {
+		for addr, b := range l.buckets {
+			if b.full(now) {
+				delete(l.buckets, addr)
+			}
+		}
+		l.swept = now
+	}
+	b, ok := l.buckets[client]
+	if !ok || b.rate != rate {
+		b = newBucket(rate, now)
+		l.buckets[client] = b
+	}
+	return b.take(now)
+}
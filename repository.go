@@ -3,9 +3,12 @@ package eventsource
 import (
 	"sort"
 	"sync"
+	"time"
 )
 
-// Example repository that uses a slice as storage for past events.
+// Example repository that uses a slice as storage for past events, which is also handy for tests.
+// Each channel's events are replayed in the order they were added. Adding an event with the same id as one
+// already held replaces it, keeping its place.
 type SliceRepository struct {
 	events map[string][]Event
 	lock   sync.RWMutex
@@ -17,34 +20,239 @@ func NewSliceRepository() *SliceRepository {
 	}
 }
 
-func (repo SliceRepository) indexOfEvent(channel, id string) int {
-	return sort.Search(len(repo.events[channel]), func(i int) bool {
-		return repo.events[channel][i].Id() >= id
-	})
+// Returns the index of the latest event with the id, or -1 if there's none
+func (repo *SliceRepository) indexOfEvent(channel, id string) int {
+	events := repo.events[channel]
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].Id() == id {
+			return i
+		}
+	}
+	return -1
 }
 
-func (repo SliceRepository) Replay(channel, id string) (out chan Event) {
-	out = make(chan Event)
-	go func() {
-		defer close(out)
-		repo.lock.RLock()
-		defer repo.lock.RUnlock()
-		events := repo.events[channel][repo.indexOfEvent(channel, id):]
-		for i := range events {
-			out <- events[i]
-		}
-	}()
+// Replays the events from the specified id onwards, including the event with that id. If the id is empty or
+// unknown all the channel's events are replayed. The returned channel holds all the events and is already closed,
+// so reading it can't block and nothing is left running if it isn't read to the end.
+func (repo *SliceRepository) Replay(channel, id string) (out chan Event) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+	events := repo.events[channel]
+	if i := repo.indexOfEvent(channel, id); len(id) > 0 && i >= 0 {
+		events = events[i:]
+	}
+	out = make(chan Event, len(events))
+	for _, ev := range events {
+		out <- ev
+	}
+	close(out)
 	return
 }
 
+// Store adds an event published to a channel the repository is registered for, as Add does.
+func (repo *SliceRepository) Store(channel string, event Event) error {
+	repo.Add(channel, event)
+	return nil
+}
+
 func (repo *SliceRepository) Add(channel string, event Event) {
 	repo.lock.Lock()
 	defer repo.lock.Unlock()
-	i := repo.indexOfEvent(channel, event.Id())
-	if i < len(repo.events[channel]) && repo.events[channel][i].Id() == event.Id() {
+	if i := repo.indexOfEvent(channel, event.Id()); len(event.Id()) > 0 && i >= 0 {
 		repo.events[channel][i] = event
-	} else {
-		repo.events[channel] = append(repo.events[channel][:i], append([]Event{event}, repo.events[channel][i:]...)...)
+		return
+	}
+	repo.events[channel] = append(repo.events[channel], event)
+}
+
+// Repository which keeps the most recent events for each channel, up to a fixed number of events.
+type RingBufferRepository struct {
+	size   int
+	events map[string]*ring
+	lock   sync.RWMutex
+}
+
+type ring struct {
+	events []Event
+	next   int
+}
+
+// Create a repository which holds up to size events for each channel. A size below 1 holds 1 event.
+func NewRingBufferRepository(size int) *RingBufferRepository {
+	if size < 1 {
+		size = 1
+	}
+	return &RingBufferRepository{
+		size:   size,
+		events: make(map[string]*ring),
+	}
+}
+
+// Returns the events oldest first
+func (r *ring) ordered() []Event {
+	if len(r.events) < cap(r.events) {
+		return append([]Event(nil), r.events...)
+	}
+	return append(append([]Event(nil), r.events[r.next:]...), r.events[:r.next]...)
+}
+
+// Replays the events which followed the specified id. If the id is empty all the held events are replayed,
+// as they are if it's unknown because it has already been overwritten, following UnknownId.
+func (repo *RingBufferRepository) Replay(channel, id string) (out chan Event) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+	var events []Event
+	if r, ok := repo.events[channel]; ok {
+		events = r.ordered()
+	}
+	found := len(id) == 0
+	for i := len(events) - 1; i >= 0 && !found; i-- {
+		if found = events[i].Id() == id; found {
+			events = events[i+1:]
+		}
+	}
+	out = make(chan Event, len(events)+1)
+	if !found {
+		out <- UnknownId
+	}
+	for _, ev := range events {
+		out <- ev
+	}
+	close(out)
+	return
+}
+
+// Add an event to a channel, overwriting the oldest event if the channel is full.
+func (repo *RingBufferRepository) Add(channel string, event Event) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	r, ok := repo.events[channel]
+	if !ok {
+		r = &ring{events: make([]Event, 0, repo.size)}
+		repo.events[channel] = r
+	}
+	if len(r.events) < cap(r.events) {
+		r.events = append(r.events, event)
+		return
+	}
+	r.events[r.next] = event
+	r.next = (r.next + 1) % len(r.events)
+}
+
+// Store adds an event published to a channel the repository is registered for, as Add does.
+func (repo *RingBufferRepository) Store(channel string, event Event) error {
+	repo.Add(channel, event)
+	return nil
+}
+
+// Repository which only replays events added within the last TTL.
+type TTLRepository struct {
+	ttl    time.Duration
+	events map[string][]timedEvent
+	lock   sync.RWMutex
+	stop   chan struct{}
+	clock  clock
+}
+
+type timedEvent struct {
+	event Event
+	added time.Time
+}
+
+func NewTTLRepository(ttl time.Duration) *TTLRepository {
+	return &TTLRepository{
+		ttl:    ttl,
+		events: make(map[string][]timedEvent),
+		clock:  realClock{},
+	}
+}
+
+// Replays the unexpired events which followed the specified id. If the id is empty all the unexpired events
+// are replayed, as they are if it's unknown because it has expired, following UnknownId.
+func (repo *TTLRepository) Replay(channel, id string) (out chan Event) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+	events := repo.events[channel]
+	expired := repo.clock.Now().Add(-repo.ttl)
+	start := sort.Search(len(events), func(i int) bool {
+		return events[i].added.After(expired)
+	})
+	events = events[start:]
+	found := len(id) == 0
+	for i := len(events) - 1; i >= 0 && !found; i-- {
+		if found = events[i].event.Id() == id; found {
+			events = events[i+1:]
+		}
+	}
+	out = make(chan Event, len(events)+1)
+	if !found {
+		out <- UnknownId
 	}
+	for _, ev := range events {
+		out <- ev.event
+	}
+	close(out)
 	return
 }
+
+func (repo *TTLRepository) Add(channel string, event Event) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	repo.events[channel] = append(repo.events[channel], timedEvent{event, repo.clock.Now()})
+}
+
+// Store adds an event published to a channel the repository is registered for, as Add does.
+func (repo *TTLRepository) Store(channel string, event Event) error {
+	repo.Add(channel, event)
+	return nil
+}
+
+// Discard the expired events. Replay never returns expired events, so this is only needed to reclaim memory.
+func (repo *TTLRepository) Prune() {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	expired := repo.clock.Now().Add(-repo.ttl)
+	for channel, events := range repo.events {
+		start := sort.Search(len(events), func(i int) bool {
+			return events[i].added.After(expired)
+		})
+		if start == len(events) {
+			delete(repo.events, channel)
+		} else if start > 0 {
+			repo.events[channel] = append([]timedEvent(nil), events[start:]...)
+		}
+	}
+}
+
+// Start pruning expired events in the background at the specified interval, until Stop is called.
+func (repo *TTLRepository) Start(interval time.Duration) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	if repo.stop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	repo.stop = stop
+	ticker := repo.clock.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C():
+				repo.Prune()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop pruning in the background.
+func (repo *TTLRepository) Stop() {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	if repo.stop != nil {
+		close(repo.stop)
+		repo.stop = nil
+	}
+}
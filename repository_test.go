@@ -0,0 +1,161 @@
+package eventsource
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func replayed(repo Repository, channel, id string) (ids []string) {
+	for ev := range repo.Replay(channel, id) {
+		if ev == UnknownId {
+			ids = append(ids, "unknown")
+			continue
+		}
+		ids = append(ids, ev.Id())
+	}
+	return
+}
+
+func expectReplay(t *testing.T, repo Repository, channel, id string, want ...string) {
+	got := replayed(repo, channel, id)
+	if len(got) != len(want) {
+		t.Errorf("Replaying %s from %q Expected: %v Got: %v", channel, id, want, got)
+		return
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Replaying %s from %q Expected: %v Got: %v", channel, id, want, got)
+			return
+		}
+	}
+}
+
+func TestSliceRepository(t *testing.T) {
+	repo := NewSliceRepository()
+	expectReplay(t, repo, "test", "1")
+	for _, id := range []string{"2", "1", "3", "2"} {
+		repo.Add("test", &testEvent{id, "", "slice"})
+	}
+	// In the order they were added, the second 2 replacing the first
+	expectReplay(t, repo, "test", "", "2", "1", "3")
+	expectReplay(t, repo, "test", "1", "1", "3")
+	expectReplay(t, repo, "test", "unknown", "2", "1", "3")
+	expectReplay(t, repo, "other", "")
+	// Abandoning a replay doesn't leave anything blocked
+	repo.Replay("test", "")
+	repo.Add("test", &testEvent{"4", "", "slice"})
+	expectReplay(t, repo, "test", "3", "3", "4")
+	// Ids aren't compared as strings, so 10 follows 9
+	for i := 1; i <= 11; i++ {
+		repo.Add("counted", &testEvent{strconv.Itoa(i), "", "slice"})
+	}
+	expectReplay(t, repo, "counted", "9", "9", "10", "11")
+	expectReplay(t, repo, "counted", "", "1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11")
+}
+
+func TestRingBufferRepository(t *testing.T) {
+	repo := NewRingBufferRepository(3)
+	expectReplay(t, repo, "test", "1", "unknown")
+	for i := 1; i <= 2; i++ {
+		repo.Add("test", &testEvent{strconv.Itoa(i), "", "ring"})
+	}
+	expectReplay(t, repo, "test", "1", "2")
+	for i := 3; i <= 5; i++ {
+		repo.Add("test", &testEvent{strconv.Itoa(i), "", "ring"})
+	}
+	expectReplay(t, repo, "test", "", "3", "4", "5")
+	expectReplay(t, repo, "test", "3", "4", "5")
+	expectReplay(t, repo, "test", "5")
+	// 1 has been overwritten
+	expectReplay(t, repo, "test", "1", "unknown", "3", "4", "5")
+	expectReplay(t, repo, "other", "1", "unknown")
+	expectReplay(t, repo, "other", "")
+	for _, size := range []int{0, -1} {
+		repo = NewRingBufferRepository(size)
+		repo.Add("test", &testEvent{"1", "", "ring"})
+		repo.Add("test", &testEvent{"2", "", "ring"})
+		expectReplay(t, repo, "test", "", "2")
+	}
+}
+
+func TestTTLRepository(t *testing.T) {
+	clock := newFakeClock()
+	repo := NewTTLRepository(time.Minute)
+	repo.clock = clock
+	repo.Add("test", &testEvent{"1", "", "expiring"})
+	clock.Advance(time.Second)
+	repo.Add("test", &testEvent{"2", "", "expiring"})
+	expectReplay(t, repo, "test", "1", "2")
+	// Only 1 has been held for the whole TTL
+	clock.Advance(repo.ttl - time.Second)
+	repo.Add("test", &testEvent{"3", "", "fresh"})
+	expectReplay(t, repo, "test", "", "2", "3")
+	expectReplay(t, repo, "test", "1", "unknown", "2", "3")
+	clock.Advance(time.Second)
+	expectReplay(t, repo, "test", "", "3")
+	repo.Start(time.Second)
+	defer repo.Stop()
+	clock.Advance(repo.ttl)
+	for {
+		repo.lock.RLock()
+		n := len(repo.events)
+		repo.lock.RUnlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFileRepository(t *testing.T) {
+	dir := t.TempDir()
+	repo := NewFileRepository(dir)
+	expectReplay(t, repo, "test", "1", "unknown")
+	for i := 1; i <= 4; i++ {
+		if err := repo.Add("test", &testEvent{strconv.Itoa(i), "", "line one\nline two"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := repo.Add("other/channel", &testEvent{"1", "", "elsewhere"}); err != nil {
+		t.Fatal(err)
+	}
+	// A new repository should see the same events, as if after a restart
+	repo = NewFileRepository(dir)
+	expectReplay(t, repo, "test", "2", "3", "4")
+	expectReplay(t, repo, "test", "", "1", "2", "3", "4")
+	expectReplay(t, repo, "other/channel", "", "1")
+	for ev := range repo.Replay("test", "3") {
+		if ev.Data() != "line one\nline two" {
+			t.Errorf("Expected: %q Got: %q", "line one\nline two", ev.Data())
+		}
+	}
+	if err := repo.Compact("test", 2); err != nil {
+		t.Fatal(err)
+	}
+	expectReplay(t, repo, "test", "", "3", "4")
+	expectReplay(t, repo, "test", "1", "unknown", "3", "4")
+	expectReplay(t, repo, "other/channel", "", "1")
+	if err := repo.Compact("other/channel", -1); err != nil {
+		t.Fatal(err)
+	}
+	expectReplay(t, repo, "other/channel", "")
+	expectReplay(t, repo, "test", "", "3", "4")
+}
+
+func TestFileRepositoryReadError(t *testing.T) {
+	dir := t.TempDir()
+	repo := NewFileRepository(dir)
+	// A directory in place of the channel's file opens, but can't be read
+	if err := os.Mkdir(repo.path("test"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var last Event
+	for ev := range repo.Replay("test", "") {
+		last = ev
+	}
+	if _, ok := last.(*ReplayError); !ok {
+		t.Errorf("Expected a ReplayError Got: %v", last)
+	}
+}
@@ -1,148 +1,1970 @@
 package eventsource
 
 import (
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultSubscriberBufferSize = 64
+
+var endOfStream Event = &publication{event: EndOfStreamEvent}
+
+// Returned by PublishContext once the server has been closed. Publish and the
+// server's other methods do nothing once it's closed, rather than blocking.
+var ErrServerClosed = errors.New("Eventsource: server closed")
+
+var (
+	errChannelFull       = errors.New("Eventsource: too many subscribers")
+	errNoChannels        = errors.New("Eventsource: no channels to subscribe to")
+	errNoFlusher         = errors.New("Eventsource: ResponseWriter doesn't support flushing")
+	errNotAcceptable     = errors.New("Eventsource: client doesn't accept text/event-stream")
+	errTooManySubscribes = errors.New("Eventsource: client is subscribing too often")
 )
 
 type subscription struct {
-	channel     string
-	lastEventId string
-	out         chan Event
+	id       string
+	channels []string
+	// The last event id the client received from each channel
+	lastEventIds []string
+	// When the client last synced, if it asked to replay from then rather
+	// than from a last event id
+	since time.Time
+	out   chan Event
+	// Receives nil once the subscription has been registered, after setting
+	// the repositories to replay from, if any, or the reason it was refused
+	registered chan error
+	// The repository of each channel, or nil if it has none to replay from
+	repositories []Repository
+	filter       func(Event) bool
+	// Name events after the channel they were published to
+	multiplexed bool
+	// The latest event for each coalesced key queued for the subscriber
+	mu     sync.Mutex
+	latest map[coalesced]Event
+	// The shards owning its channels, and the number still holding it
+	shards []*shard
+	refs   atomic.Int32
+	// Reported by Subscriptions
+	remoteAddr  string
+	connectedAt time.Time
+	lastEventID string
+	delivered   atomic.Int64
+}
+
+// Returns err, counting the event written to the client if it's nil
+func (sub *subscription) wrote(err error) error {
+	if err == nil {
+		sub.delivered.Add(1)
+	}
+	return err
+}
+
+// A snapshot of a subscription, as returned by Subscriptions
+type SubscriptionInfo struct {
+	// As returned by SubscriptionID for the subscriber's request
+	ID          string
+	Channels    []string
+	RemoteAddr  string
+	ConnectedAt time.Time
+	// The last event id the client sent when subscribing, if any
+	LastEventID string
+	// The number of events from its channels written to the client so far,
+	// including those replayed
+	EventsDelivered int64
+	// The number of events waiting to be written to the client, showing how
+	// far behind it is
+	Queued int
+}
+
+// Reports whether events are to be replayed from the repository by when they
+// were published rather than by id
+func (sub *subscription) replaysSince(repo Repository) bool {
+	_, ok := repo.(TimeRepository)
+	return ok && !sub.since.IsZero()
+}
+
+// Returns true once no shard holds the subscription any longer, so that
+// nothing more can be queued and the queue can be closed
+func (sub *subscription) release() bool {
+	return sub.refs.Add(-1) == 0
+}
+
+// Queued in place of an event whose key is coalesced, so that the event can
+// be replaced by later ones with the same key until the handler takes it
+type coalesced struct {
+	channel, key string
+}
+
+func (coalesced) Id() string    { return "" }
+func (coalesced) Event() string { return "" }
+func (coalesced) Data() string  { return "" }
+
+// Returns true if an event with the same key was already queued, so that
+// ev has taken its place and nothing more needs to be queued
+func (sub *subscription) coalesce(key coalesced, ev Event) bool {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	_, queued := sub.latest[key]
+	if sub.latest == nil {
+		sub.latest = make(map[coalesced]Event)
+	}
+	sub.latest[key] = ev
+	return queued
+}
+
+// Returns the event to send in place of one taken from the queue
+func (sub *subscription) resolve(ev Event) Event {
+	key, ok := ev.(coalesced)
+	if !ok {
+		return ev
+	}
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	ev = sub.latest[key]
+	delete(sub.latest, key)
+	return ev
+}
+
+func (sub *subscription) lastEventId(i int) string {
+	if i < len(sub.lastEventIds) {
+		return sub.lastEventIds[i]
+	}
+	return ""
+}
+
+func (sub *subscription) accepts(ev Event) bool {
+	return sub.filter == nil || sub.filter(ev)
+}
+
+func (sub *subscription) tag(channel string, ev Event) Event {
+	if !sub.multiplexed {
+		return ev
+	}
+	name := channel
+	if len(ev.Event()) > 0 {
+		name += ":" + ev.Event()
+	}
+	return &relabelledEvent{ev, ev.Id(), name, channel}
 }
 
 type outbound struct {
 	channels []string
 	event    Event
+	// If set, receives the number of subscribers the event was queued for
+	queued chan int
 }
 type registration struct {
 	channel    string
 	repository Repository
 }
+type unicast struct {
+	id    string
+	event Event
+}
+type subscriberCount struct {
+	channel string
+	count   chan int
+}
 
-type Server struct {
-	// Enable all handlers to be accessible from any origin
-	AllowCORS     bool
+type repositoryLookup struct {
+	channel string
+	found   chan bool
+}
+
+// The channels whose names hash to a shard are run by its own goroutine, so
+// that they can be published to in parallel with those of other shards
+type shard struct {
 	registrations chan *registration
 	pub           chan *outbound
+	broadcasts    chan Event
 	subs          chan *subscription
 	unregister    chan *subscription
+	unicasts      chan *unicast
+	closings      chan string
+	// Presence events for the PresenceChannel, from the other shards
+	announcements chan Event
+	counts        chan *subscriberCount
+	listings      chan chan []string
+	lookups       chan *repositoryLookup
+	inspections   chan chan []SubscriptionInfo
 	quit          chan bool
+	done          chan struct{}
 }
 
-// Create a new Server ready for handler creation and publishing events
-func NewServer() *Server {
-	srv := &Server{
+func newShard() *shard {
+	return &shard{
 		registrations: make(chan *registration),
 		pub:           make(chan *outbound),
+		broadcasts:    make(chan Event),
 		subs:          make(chan *subscription),
 		unregister:    make(chan *subscription),
+		unicasts:      make(chan *unicast),
+		closings:      make(chan string),
+		announcements: make(chan Event),
+		counts:        make(chan *subscriberCount),
+		listings:      make(chan chan []string),
+		lookups:       make(chan *repositoryLookup),
+		inspections:   make(chan chan []SubscriptionInfo),
 		quit:          make(chan bool),
+		done:          make(chan struct{}),
+	}
+}
+
+type Server struct {
+	// Enable all handlers to be accessible from any origin
+	AllowCORS bool
+	// Origins which may access the handlers with credentials. A matching
+	// Origin header is echoed back, which unlike the AllowCORS wildcard
+	// browsers accept for requests made withCredentials.
+	AllowedOrigins []string
+	// If non-zero, a comment is sent to clients which haven't received an
+	// event within this interval, to stop proxies dropping idle connections
+	KeepAlive time.Duration
+	// Send each keepalive as a bare newline rather than a comment. A blank
+	// line between events is ignored by clients, and at one byte it's the
+	// cheapest way to keep NAT mappings and proxies from timing out, for
+	// servers with many idle clients. Comments are the more portable, as
+	// clients which don't follow the specification closely may take a blank
+	// line for an empty event, and unlike a blank line they can be observed,
+	// such as through a Decoder's Comments. Clients of the binary framing are
+	// still sent comments.
+	HeartbeatByte bool
+	// Compress the stream for clients which accept gzip encoding
+	EnableCompression bool
+	// Name of the query parameter used for the last event id when the
+	// Last-Event-ID header is absent, for clients which can't set headers.
+	// Defaults to "lastEventId".
+	LastEventIdParam string
+	// Name of the query parameter in which clients without a last event id
+	// can pass when they last synced, in milliseconds since the Unix epoch,
+	// to have events replayed from then by repositories implementing
+	// TimeRepository. Defaults to "since".
+	SinceParam string
+	// Number of events which can be queued for each subscriber, including
+	// those published while replaying. A subscriber whose queue is full is
+	// disconnected, so that it can't hold up publishing to everyone else.
+	// Defaults to 64.
+	SubscriberBufferSize int
+	// How long to wait for space in a full subscriber queue before
+	// disconnecting the subscriber. Publishing is held up while waiting.
+	SendTimeout time.Duration
+	// Called from the handler's goroutine when a client subscribes to a
+	// channel, and exactly once more when that subscription ends. The
+	// subscription's id for PublishTo can be had from SubscriptionID(r).
+	OnSubscribe   func(channel string, r *http.Request)
+	OnUnsubscribe func(channel string)
+	// If set, called before a client is subscribed to a channel. Returning an
+	// error rejects the client with a 403 Forbidden, or with the error's own
+	// status if it has a StatusCode() int method.
+	Authorize func(channel string, r *http.Request) error
+	// Assign an id to published events which don't have one, from a counter
+	// kept for each channel. As the counters start again from 1 when the
+	// server is restarted, ids from before a restart can't be resumed from.
+	// A channel's counter also starts again once it has neither subscribers
+	// nor a repository, such as after CloseChannel, so that channels which
+	// come and go aren't remembered.
+	AutoID bool
+	// The most clients which can subscribe to a channel at once. Further
+	// clients are turned away with a 503 Service Unavailable. Zero means no
+	// limit.
+	MaxSubscribersPerChannel int
+	// If set, an event named "subscriber-joined" or "subscriber-left" is
+	// published to this channel whenever a client subscribes to or leaves
+	// any other channel. Its data is a JSON object holding the channel and
+	// its new number of subscribers, such as {"channel":"news","subscribers":3}.
+	PresenceChannel string
+	// Called with any error which ends a subscription, such as a failure to
+	// write to the client. If nil, errors are logged to ErrorLog instead.
+	OnError func(channel string, err error)
+	// Logger for errors when OnError isn't set. If nil, errors are logged to
+	// the log package's standard logger.
+	ErrorLog *log.Logger
+	// If non-zero, events are written to clients as they're published but
+	// only flushed at this interval, reducing the number of writes to busy
+	// connections at the cost of latency. Keepalives are always flushed.
+	FlushInterval time.Duration
+	// Send X-Accel-Buffering: no, so that nginx passes events on as they're
+	// written rather than buffering the response. Other proxies need their
+	// buffering turned off in their own configuration, such as Apache's
+	// flushpackets=on or HAProxy's "option http-no-delay". Set by NewServer.
+	DisableProxyBuffering bool
+	// If set, called once a client has subscribed to a channel for an event
+	// holding the channel's current state, which is sent ahead of any
+	// replayed events and isn't filtered. Returning nil sends nothing.
+	SnapshotFunc func(channel string, r *http.Request) Event
+	// If set, called for each event published to a channel and each of its
+	// subscribers. Events for which it returns a key, such as the event's
+	// name, replace any event with the same key that is still queued for
+	// the subscriber rather than queueing behind it. Slow subscribers then
+	// only receive the latest value for each key, skipping the ones in
+	// between. Returning an empty key queues the event as usual.
+	CoalesceKey func(channel string, ev Event) string
+	// If set, told about events being published, delivered and dropped, and
+	// subscribers coming and going
+	Metrics Metrics
+	// Replay a channel's whole repository to clients which subscribe without
+	// a last event id, as well as replaying what was missed to those with one
+	ReplayAll bool
+	// Headers sent with every stream, replacing the defaults with the same
+	// names, such as Cache-Control. A name with no values removes the
+	// default header. The default Content-Type, "text/event-stream;
+	// charset=utf-8", can be replaced too, for instance by plain
+	// "text/event-stream" for clients which don't expect a charset, though
+	// not for clients of the binary framing, which are always sent
+	// BinaryContentType.
+	ResponseHeaders http.Header
+	// If non-zero, the longest a write to a client can take, including
+	// flushing, before the client is disconnected. Streams aren't subject to
+	// the WriteTimeout of the http.Server, which would otherwise end them.
+	WriteTimeout time.Duration
+	// Send subscribers an EndOfStreamEvent before disconnecting them through
+	// CloseChannel, Close or Shutdown, telling clients not to reconnect
+	SendEndOfStream bool
+	// If set, written as is to each client before anything else, for clients
+	// with quirks such as old browsers which wait for 2KB of data before
+	// processing the stream. It must be valid in the stream, such as a byte
+	// order mark or a comment: ":" + strings.Repeat(" ", 2048) + "\n".
+	Preamble []byte
+	// If non-zero, the most events which can be published to each channel
+	// per second, on average, allowing bursts of up to a second's worth.
+	// Events over the limit are dropped and reported to OnRateLimited,
+	// unless BlockRateLimited is set, when publishing waits until the event
+	// can be sent. As all publishing waits, that also holds up the other
+	// channels of the same shard. A channel's allowance is full again once it
+	// has had neither subscribers nor a repository, so events published to a
+	// channel nobody is subscribed to don't count against it.
+	MaxEventsPerSecond float64
+	BlockRateLimited   bool
+	OnRateLimited      func(channel string)
+	// The number of goroutines among which channels are shared out, by
+	// hashing their names, so that publishing to channels of different
+	// shards proceeds in parallel. Functions such as CoalesceKey may then be
+	// called concurrently. It must be set before the server is first used.
+	// Defaults to 1.
+	Shards int
+	// Respond with 406 Not Acceptable to requests whose Accept header
+	// includes neither text/event-stream, as sent by EventSource, nor
+	// BinaryContentType, so that crawlers and health checks don't hold
+	// connections open as subscribers
+	RequireAcceptHeader bool
+	// If non-zero, the most subscriptions per second each client, identified
+	// by the host of its request's RemoteAddr, can make on average, allowing
+	// bursts of up to a second's worth. Clients over the limit are turned away
+	// with a 429 Too Many Requests, and a Retry-After header saying when
+	// they can next subscribe.
+	SubscribeRateLimit float64
+	// Send each client a comment holding its subscription's id, as given by
+	// SubscriptionID, such as ": id=5f2b...", before any events, so that it
+	// can ask for events to be sent to it alone with PublishTo
+	SendSubscriberID bool
+	// Never replay events from repositories, even to clients with a last
+	// event id, so that every client only receives live events. Repositories
+	// implementing Storer are still given the events published.
+	DisableReplay bool
+	// Paths, such as "/static/bootstrap.js", pushed through http.Pusher to
+	// clients connected over HTTP/2 before their stream starts, so that what
+	// a page needs alongside the stream is already on its way. Clients which
+	// don't accept pushes, such as those connected over HTTP/1.1, are sent
+	// the stream alone.
+	PushTargets []string
+	// If non-zero, the MaxLineLength of each client's Encoder, for streams
+	// passing through proxies which drop or break up longer lines. An event
+	// with a longer line is skipped and its ErrLineTooLong reported, like an
+	// event with an invalid field. Clients of the binary framing aren't
+	// limited.
+	MaxLineLength int
+
+	shards     []*shard
+	started    sync.Once
+	closing    sync.Once
+	subscribes clientLimiter
+	tapMu      sync.RWMutex
+	taps       map[chan TappedEvent]struct{}
+	clock      clock
+	closed     chan struct{} // when Close is called
+	done       chan struct{} // once the shards have all stopped
+	handlers   sync.WaitGroup
+}
+
+// Create a new Server ready for handler creation and publishing events
+func NewServer() *Server {
+	srv := &Server{
+		DisableProxyBuffering: true,
+
+		clock:  realClock{},
+		taps:   make(map[chan TappedEvent]struct{}),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
 	}
-	go srv.run()
 	return srv
 }
 
-// Stop handling publishing
+// The shards are started when the server is first used, once Shards is set
+func (srv *Server) start() []*shard {
+	srv.started.Do(func() {
+		n := srv.Shards
+		if n < 1 {
+			n = 1
+		}
+		srv.shards = make([]*shard, n)
+		for i := range srv.shards {
+			srv.shards[i] = newShard()
+		}
+		var running sync.WaitGroup
+		for _, sh := range srv.shards {
+			running.Add(1)
+			go func(sh *shard) {
+				defer running.Done()
+				srv.run(sh)
+			}(sh)
+		}
+		go func() {
+			running.Wait()
+			srv.tapMu.Lock()
+			defer srv.tapMu.Unlock()
+			for tap := range srv.taps {
+				close(tap)
+			}
+			srv.taps = nil
+			close(srv.done)
+		}()
+	})
+	return srv.shards
+}
+
+// Returns the shard running the channel
+func (srv *Server) owner(channel string) *shard {
+	shards := srv.start()
+	if len(shards) == 1 {
+		return shards[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(channel))
+	return shards[h.Sum32()%uint32(len(shards))]
+}
+
+// Returns the shards holding subscribers to the channel: every shard for a
+// pattern, which can match channels run by any of them
+func (srv *Server) owners(channel string) []*shard {
+	if isPattern(channel) {
+		return srv.start()
+	}
+	return []*shard{srv.owner(channel)}
+}
+
+// Reports whether the channel is a pattern, having a segment which is "*"
+func isPattern(channel string) bool {
+	return channel == "*" || strings.HasPrefix(channel, "*.") || strings.HasSuffix(channel, ".*") ||
+		strings.Contains(channel, ".*.")
+}
+
+// Reports whether the channel matches the pattern, segment by segment, a
+// segment of "*" matching any non-empty one
+func matchChannel(pattern, channel string) bool {
+	for {
+		p, patternRest, patternMore := strings.Cut(pattern, ".")
+		c, channelRest, channelMore := strings.Cut(channel, ".")
+		if p == "*" && len(c) == 0 || p != "*" && p != c || patternMore != channelMore {
+			return false
+		}
+		if !patternMore {
+			return true
+		}
+		pattern, channel = patternRest, channelRest
+	}
+}
+
+// Groups the channels by the shard running them
+func (srv *Server) split(channels []string) map[*shard][]string {
+	if shards := srv.start(); len(shards) == 1 {
+		return map[*shard][]string{shards[0]: channels}
+	}
+	parts := make(map[*shard][]string)
+	for _, c := range channels {
+		sh := srv.owner(c)
+		parts[sh] = append(parts[sh], c)
+	}
+	return parts
+}
+
+// Stop handling publishing. Closing the server again does nothing.
 func (srv *Server) Close() {
-	srv.quit <- true
+	srv.closing.Do(func() {
+		close(srv.closed)
+		for _, sh := range srv.start() {
+			sh.quit <- true
+		}
+	})
+}
+
+// Stop handling publishing, then wait for the handlers to send their
+// subscribers any events which are still queued and return. If the context
+// expires first, its error is returned.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.Close()
+	finished := make(chan struct{})
+	go func() {
+		srv.handlers.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-// Create a new handler for serving a specified channel
+// Create a new handler for serving a specified channel. Clients whose Accept
+// header includes BinaryContentType are sent the stream in the binary
+// framing a BinaryDecoder reads, as they are by the other handlers.
+//
+// The channel can be a pattern, such as "orders.*", to serve the events
+// published to every channel it matches, such as "orders.123" and
+// "orders.456". Channel names are divided into segments by dots, and a segment
+// which is just "*" matches any one non-empty segment, so "orders.*" matches
+// neither "orders" nor "orders.123.items", while "*.items" matches the
+// latter. Any of the handlers can be given patterns. Subscribers to a pattern
+// are counted, announced and closed under the pattern itself rather than the
+// channels it matches, and are replayed to from the repository registered
+// for the pattern, if any. Each event published is checked against every
+// pattern subscribed to, and with several Shards, each shard holds every
+// pattern, so they're best kept few.
 func (srv *Server) Handler(channel string) http.HandlerFunc {
+	return srv.FilteredHandler(channel, nil)
+}
+
+// Create a new handler for serving a specified channel, which only sends
+// the events for which filter returns true. The filter is called from the
+// handler's goroutine, so a slow filter only holds up its own client.
+func (srv *Server) FilteredHandler(channel string, filter func(Event) bool) http.HandlerFunc {
+	return srv.handler([]string{channel}, false, filter, nil)
+}
+
+// Create a new handler which serves the channel chosen by chooser for each
+// request, for instance from a path variable. Requests for which it returns
+// an empty string are rejected with a 400 Bad Request.
+func (srv *Server) HandlerFunc(chooser func(*http.Request) string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		channel := chooser(req)
+		if len(channel) == 0 {
+			http.Error(w, errNoChannels.Error(), http.StatusBadRequest)
+			return
+		}
+		srv.handler([]string{channel}, false, nil, nil)(w, req)
+	}
+}
+
+// Create a new handler which serves events from several channels over one
+// connection. Each event is named after the channel it was published to, or
+// "channel:name" if it already has a name, so that clients can tell them apart.
+// As ids are only meaningful within a channel, each event's id records the last
+// id sent from every channel, so that a reconnecting client resumes them all.
+// Subscribers count towards each channel's limit and presence.
+func (srv *Server) MultiHandler(channels []string) http.HandlerFunc {
+	return srv.handler(channels, true, nil, nil)
+}
+
+// Create a new handler for serving a specified channel, which sends each
+// client the event returned by init for its request, such as one holding a
+// CSRF token or the client's settings, before anything else: ahead of any
+// snapshot, replayed events and live events. Returning nil sends nothing.
+func (srv *Server) HandlerWithInit(channel string, init func(*http.Request) Event) http.HandlerFunc {
+	return srv.handler([]string{channel}, false, nil, init)
+}
+
+func (srv *Server) handler(channels []string, multiplexed bool, filter func(Event) bool, init func(*http.Request) Event) http.HandlerFunc {
+	// Names the subscription when reporting errors
+	name := strings.Join(channels, ",")
 	return func(w http.ResponseWriter, req *http.Request) {
+		binary := accepts(req, BinaryContentType)
+		if srv.RequireAcceptHeader && !accepts(req, "text/event-stream") && !binary {
+			http.Error(w, errNotAcceptable.Error(), http.StatusNotAcceptable)
+			return
+		}
+		// Middleware which wraps the ResponseWriter without passing on Flush
+		// or Unwrap would leave events stuck in its buffer
+		if !canFlush(w) {
+			http.Error(w, errNoFlusher.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !srv.admit(w, req, channels) {
+			return
+		}
 		h := w.Header()
-		h.Set("Content-Type", "text/event-stream; charset=utf-8")
+		if binary {
+			h.Set("Content-Type", BinaryContentType)
+		} else {
+			h.Set("Content-Type", "text/event-stream; charset=utf-8")
+		}
 		h.Set("Cache-Control", "no-cache, no-store, must-revalidate")
-		h.Set("Connection", "keep-alive")
-		if srv.AllowCORS {
+		// HTTP/2 forbids connection-specific headers
+		if req.ProtoMajor < 2 {
+			h.Set("Connection", "keep-alive")
+		}
+		if srv.DisableProxyBuffering {
+			h.Set("X-Accel-Buffering", "no")
+		}
+		for k, v := range srv.ResponseHeaders {
+			if binary && http.CanonicalHeaderKey(k) == "Content-Type" {
+				continue
+			}
+			h.Del(k)
+			for _, value := range v {
+				h.Add(k, value)
+			}
+		}
+		if len(srv.AllowedOrigins) > 0 {
+			h.Add("Vary", "Origin")
+		}
+		if origin := req.Header.Get("Origin"); srv.allowedOrigin(origin) {
+			h.Set("Access-Control-Allow-Origin", origin)
+			h.Set("Access-Control-Allow-Credentials", "true")
+		} else if srv.AllowCORS {
 			h.Set("Access-Control-Allow-Origin", "*")
 		}
+		id := newSubscriptionID()
+		req = req.WithContext(context.WithValue(req.Context(), subscriptionIDKey{}, id))
+		lastEventIds, cursor := scopeLastEventId(channels, srv.lastEventId(req), multiplexed)
 		sub := &subscription{
-			channel:     channel,
-			lastEventId: req.Header.Get("Last-Event-ID"),
-			out:         make(chan Event),
+			id:           id,
+			channels:     channels,
+			lastEventIds: lastEventIds,
+			since:        srv.since(req),
+			out:          make(chan Event, srv.bufferSize()),
+			filter:       filter,
+			multiplexed:  multiplexed,
+			remoteAddr:   req.RemoteAddr,
+			connectedAt:  srv.clock.Now(),
+			lastEventID:  srv.lastEventId(req),
+		}
+		accepted, err := srv.add(sub)
+		defer srv.handlers.Add(-accepted)
+		if err != nil {
+			srv.unsubscribe(sub)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		for _, channel := range channels {
+			if srv.OnSubscribe != nil {
+				srv.OnSubscribe(channel, req)
+			}
+			if srv.OnUnsubscribe != nil {
+				defer srv.OnUnsubscribe(channel)
+			}
+		}
+		srv.push(w, name)
+		// The http.Server's WriteTimeout would end every stream, so it's
+		// replaced by the Server's own timeout for each write
+		rc := http.NewResponseController(w)
+		rc.SetWriteDeadline(time.Time{})
+		defer rc.SetWriteDeadline(time.Time{})
+		dw := &deadlineWriter{w, rc, srv.WriteTimeout}
+		var out io.Writer = dw
+		var flusher http.Flusher = dw
+		if srv.EnableCompression {
+			// Caches must tell compressed and uncompressed responses apart
+			h.Add("Vary", "Accept-Encoding")
+		}
+		if srv.EnableCompression && acceptsGzip(req) {
+			h.Set("Content-Encoding", "gzip")
+			gz := &gzipWriter{gzip.NewWriter(dw), flusher}
+			defer gz.Close()
+			out, flusher = gz, gz
+		}
+		// The preamble is only meaningful in the text format
+		if len(srv.Preamble) > 0 && !binary {
+			if _, err := out.Write(srv.Preamble); err != nil {
+				srv.unsubscribe(sub)
+				srv.error(name, err)
+				return
+			}
 		}
-		srv.subs <- sub
-		flusher := w.(http.Flusher)
-		notifier := w.(http.CloseNotifier)
 		flusher.Flush()
-		enc := newEncoder(w)
+		var enc streamEncoder
+		if binary {
+			enc = NewBinaryEncoder(out)
+		} else {
+			text := NewEncoder(out)
+			text.MaxLineLength = srv.MaxLineLength
+			enc = text
+		}
+		if srv.SendSubscriberID {
+			if err := enc.Comment("id=" + id); err != nil {
+				srv.unsubscribe(sub)
+				srv.error(name, err)
+				return
+			}
+		}
+		// Whatever is sent ahead of the live events is flushed all at once
+		enc.Batch()
+		var initial Event
+		if init != nil {
+			initial = init(req)
+		}
+		if initial != nil {
+			if err := enc.Encode(initial); err != nil && !srv.invalidEvent(name, err) {
+				srv.unsubscribe(sub)
+				srv.error(name, err)
+				return
+			}
+		}
+		if srv.SnapshotFunc != nil {
+			for _, channel := range channels {
+				ev := srv.SnapshotFunc(channel, req)
+				if ev == nil {
+					continue
+				}
+				if err := sub.wrote(enc.Encode(cursor(sub.tag(channel, ev)))); srv.invalidEvent(name, err) {
+					continue
+				} else if err != nil {
+					srv.unsubscribe(sub)
+					srv.error(name, err)
+					return
+				}
+			}
+		}
+		recent, err := srv.catchUp(req.Context(), sub, name, func(ev Event) error {
+			return sub.wrote(enc.Encode(cursor(ev)))
+		})
+		if err == nil {
+			err = enc.Flush()
+		}
+		if err != nil {
+			srv.unsubscribe(sub)
+			// Going away while catching up isn't an error
+			if req.Context().Err() == nil {
+				srv.error(name, err)
+			}
+			return
+		}
+		replayed := newReplayFilter(recent, len(sub.out))
+		var keepalive ticker
+		var tick <-chan time.Time
+		if srv.KeepAlive > 0 {
+			keepalive = srv.clock.NewTicker(srv.KeepAlive)
+			defer keepalive.Stop()
+			tick = keepalive.C()
+		}
+		// Receives when events written since the last flush are due to be flushed
+		var flush <-chan time.Time
 		for {
 			select {
-			case <-notifier.CloseNotify():
-				srv.unregister <- sub
+			case <-req.Context().Done():
+				srv.unsubscribe(sub)
 				return
+			case <-tick:
+				// Also flushes any pending events
+				var err error
+				if srv.HeartbeatByte && !binary {
+					if _, err = io.WriteString(out, "\n"); err == nil {
+						flusher.Flush()
+					}
+				} else {
+					err = enc.Comment("keepalive")
+				}
+				if err != nil {
+					srv.unsubscribe(sub)
+					srv.error(name, err)
+					return
+				}
+				flush = nil
+			case <-flush:
+				flusher.Flush()
+				flush = nil
 			case ev, ok := <-sub.out:
 				if !ok {
+					if flush != nil {
+						flusher.Flush()
+					}
 					return
 				}
-				if err := enc.Encode(ev); err != nil {
-					srv.unregister <- sub
-					log.Println(err)
+				if ev = sub.resolve(ev); ev != endOfStream && !sub.accepts(ev) {
+					continue
+				}
+				if replayed.duplicate(ev) {
+					continue
+				}
+				if err := sub.wrote(enc.Encode(cursor(ev))); srv.invalidEvent(name, err) {
+					continue
+				} else if err != nil {
+					srv.unsubscribe(sub)
+					srv.error(name, err)
 					return
 				}
-				flusher.Flush()
+				if srv.FlushInterval <= 0 {
+					flusher.Flush()
+				} else if flush == nil {
+					flush = srv.clock.After(srv.FlushInterval)
+				}
+				if keepalive != nil {
+					keepalive.Reset(srv.KeepAlive)
+				}
+			}
+		}
+	}
+}
+
+// Writes a handler's stream, in the text format or the binary one
+type streamEncoder interface {
+	Encode(ev Event) error
+	Comment(text string) error
+	Batch()
+	Flush() error
+}
+
+// Event ids are only meaningful within the channel they were published to,
+// and different channels may use the same ids. So that a subscription to
+// several channels can resume each of them, the ids sent by MultiHandler
+// are the last id received from each channel, form encoded as in
+// "news=5&sport=3". Returns the last event id of each channel, and a
+// function which replaces the id of each event to be sent accordingly.
+func scopeLastEventId(channels []string, lastEventId string, multiplexed bool) ([]string, func(Event) Event) {
+	if !multiplexed {
+		return []string{lastEventId}, func(ev Event) Event { return ev }
+	}
+	// An id which can't be parsed resumes none of the channels
+	parsed, _ := url.ParseQuery(lastEventId)
+	positions := make(url.Values)
+	ids := make([]string, len(channels))
+	for i, channel := range channels {
+		if ids[i] = parsed.Get(channel); len(ids[i]) > 0 {
+			positions.Set(channel, ids[i])
+		}
+	}
+	return ids, func(ev Event) Event {
+		r, ok := ev.(*relabelledEvent)
+		if !ok || len(r.channel) == 0 || len(r.id) == 0 {
+			return ev
+		}
+		if r.id == ResetId {
+			positions.Del(r.channel)
+		} else {
+			positions.Set(r.channel, r.id)
+		}
+		id := positions.Encode()
+		if len(id) == 0 {
+			id = ResetId
+		}
+		return &relabelledEvent{r.ev, id, r.event, r.channel}
+	}
+}
+
+// Pushes the PushTargets, if the client accepts pushes. They must be pushed
+// before the stream's headers are written.
+func (srv *Server) push(w http.ResponseWriter, name string) {
+	pusher, ok := w.(http.Pusher)
+	if !ok {
+		return
+	}
+	for _, target := range srv.PushTargets {
+		if err := pusher.Push(target, nil); err == http.ErrNotSupported {
+			return
+		} else if err != nil {
+			srv.error(name, err)
+		}
+	}
+}
+
+// Reports whether a client may subscribe to the channels, turning it away if
+// it's subscribing too often or isn't authorized
+func (srv *Server) admit(w http.ResponseWriter, req *http.Request, channels []string) bool {
+	if srv.SubscribeRateLimit > 0 {
+		client, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			client = req.RemoteAddr
+		}
+		if wait := srv.subscribes.take(client, srv.SubscribeRateLimit, srv.clock.Now()); wait > 0 {
+			secs := int64((wait + time.Second - 1) / time.Second)
+			w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+			http.Error(w, errTooManySubscribes.Error(), http.StatusTooManyRequests)
+			return false
+		}
+	}
+	if srv.Authorize != nil {
+		for _, channel := range channels {
+			if err := srv.Authorize(channel, req); err != nil {
+				status := http.StatusForbidden
+				if coder, ok := err.(interface{ StatusCode() int }); ok {
+					status = coder.StatusCode()
+				}
+				http.Error(w, err.Error(), status)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (srv *Server) bufferSize() int {
+	if srv.SubscriberBufferSize <= 0 {
+		return defaultSubscriberBufferSize
+	}
+	return srv.SubscriberBufferSize
+}
+
+// Sends the subscriber the events to replay from its channels' repositories.
+// Events which can't be encoded are reported and skipped, while any other
+// error from send is returned, as is the context's error if the client goes
+// away first. Also returns the keys of the latest events replayed, which may
+// also have been queued since subscribing.
+func (srv *Server) catchUp(ctx context.Context, sub *subscription, name string, send func(Event) error) ([]string, error) {
+	var recent []string
+	for i, repo := range sub.repositories {
+		if repo == nil {
+			continue
+		}
+		var events <-chan Event
+		if sub.replaysSince(repo) {
+			events = repo.(TimeRepository).ReplaySince(sub.channels[i], sub.since)
+		} else {
+			events = replay(ctx, repo, sub.channels[i], sub.lastEventId(i))
+		}
+		for {
+			var ev Event
+			var ok bool
+			select {
+			case ev, ok = <-events:
+			case <-ctx.Done():
+				go discard(events)
+				return nil, ctx.Err()
+			}
+			if !ok {
+				break
+			}
+			failed, truncated := ev.(*ReplayError)
+			if truncated {
+				srv.error(sub.channels[i], failed)
+			}
+			if ev == UnknownId || truncated {
+				ev = &publication{event: ResyncEvent, data: sub.lastEventId(i)}
+			} else if !sub.accepts(ev) {
+				continue
+			}
+			ev = sub.tag(sub.channels[i], ev)
+			if key, ok := replayKey(ev); ok {
+				if len(recent) == cap(sub.out) {
+					recent = recent[1:]
+				}
+				recent = append(recent, key)
+			}
+			if err := send(ev); srv.invalidEvent(name, err) {
+				continue
+			} else if err != nil {
+				go discard(events)
+				return nil, err
 			}
+			if srv.Metrics != nil {
+				srv.Metrics.EventDelivered(sub.channels[i])
+			}
+			if truncated {
+				go discard(events)
+				break
+			}
+		}
+	}
+	return recent, nil
+}
+
+// Reports whether err is an event's ErrInvalidField or ErrLineTooLong,
+// reporting it too. Only the event is at fault, not the client, so it's
+// skipped and the client kept.
+func (srv *Server) invalidEvent(name string, err error) bool {
+	if !errors.Is(err, ErrInvalidField) && !errors.Is(err, ErrLineTooLong) {
+		return false
+	}
+	srv.error(name, err)
+	return true
+}
+
+// Receives the rest of the events from a replay which has been abandoned, so
+// that the Repository sending them isn't left blocked forever
+func discard(events <-chan Event) {
+	for range events {
+	}
+}
+
+// Events published after subscribing but before the repository was read
+// are both replayed and queued. They can only be among the latest replayed
+// events, as no more than a queue's worth can be waiting.
+type replayFilter struct {
+	replayed map[string]struct{}
+	// The number of queued events which might duplicate replayed ones
+	unchecked int
+}
+
+func newReplayFilter(recent []string, queued int) *replayFilter {
+	f := &replayFilter{replayed: make(map[string]struct{}, len(recent))}
+	for _, key := range recent {
+		f.replayed[key] = struct{}{}
+	}
+	if len(f.replayed) > 0 {
+		f.unchecked = queued
+	}
+	return f
+}
+
+// Reports whether an event taken from the queue has already been replayed
+func (f *replayFilter) duplicate(ev Event) bool {
+	if f.unchecked == 0 {
+		return false
+	}
+	f.unchecked--
+	key, ok := replayKey(ev)
+	if !ok {
+		return false
+	}
+	_, dup := f.replayed[key]
+	return dup
+}
+
+func replay(ctx context.Context, repo Repository, channel, id string) <-chan Event {
+	if r, ok := repo.(ContextRepository); ok {
+		return r.ReplayContext(ctx, channel, id)
+	}
+	return repo.Replay(channel, id)
+}
+
+// Identifies an event by its name, which is tagged with its channel by
+// MultiHandler, and id. Events without an id can't be identified.
+func replayKey(ev Event) (string, bool) {
+	id := ev.Id()
+	if len(id) == 0 || id == ResetId {
+		return "", false
+	}
+	return ev.Event() + "\x00" + id, true
+}
+
+type subscriptionIDKey struct{}
+
+// SubscriptionID returns the id of the subscription being served in response
+// to r, such as the request passed to the Server's OnSubscribe, or an empty
+// string if there is none.
+func SubscriptionID(r *http.Request) string {
+	id, _ := r.Context().Value(subscriptionIDKey{}).(string)
+	return id
+}
+
+func newSubscriptionID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("Eventsource: can't generate subscription id: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+func (srv *Server) allowedOrigin(origin string) bool {
+	if len(origin) == 0 {
+		return false
+	}
+	for _, allowed := range srv.AllowedOrigins {
+		if origin == allowed {
+			return true
 		}
 	}
+	return false
 }
 
-// Register the repository to be used for the specified channel
+// The Last-Event-ID header takes precedence over the query parameter.
+func (srv *Server) lastEventId(req *http.Request) string {
+	if id := req.Header.Get("Last-Event-ID"); len(id) > 0 {
+		return id
+	}
+	param := srv.LastEventIdParam
+	if len(param) == 0 {
+		param = "lastEventId"
+	}
+	return req.URL.Query().Get(param)
+}
+
+// Returns when the client asked to replay events from, or the zero time if it
+// didn't or sent a last event id, which takes precedence
+func (srv *Server) since(req *http.Request) time.Time {
+	if len(srv.lastEventId(req)) > 0 {
+		return time.Time{}
+	}
+	param := srv.SinceParam
+	if len(param) == 0 {
+		param = "since"
+	}
+	ms, err := strconv.ParseInt(req.URL.Query().Get(param), 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
+func (srv *Server) error(channel string, err error) {
+	switch {
+	case srv.OnError != nil:
+		srv.OnError(channel, err)
+	case srv.ErrorLog != nil:
+		srv.ErrorLog.Println(err)
+	default:
+		log.Println(err)
+	}
+}
+
+// Registers the subscription with each shard running its channels, returning
+// the number of shards which accepted it, each having added to the handlers.
+// If any refused it, or the server was closed, an error is returned and the
+// subscription should be unsubscribed from the rest.
+func (srv *Server) add(sub *subscription) (int, error) {
+	seen := make(map[*shard]bool)
+	for _, c := range sub.channels {
+		for _, sh := range srv.owners(c) {
+			if !seen[sh] {
+				seen[sh] = true
+				sub.shards = append(sub.shards, sh)
+			}
+		}
+	}
+	if len(sub.shards) == 0 {
+		return 0, errNoChannels
+	}
+	sub.refs.Store(int32(len(sub.shards)))
+	sub.registered = make(chan error, len(sub.shards))
+	sub.repositories = make([]Repository, len(sub.channels))
+	var err error
+	sent := 0
+	for _, sh := range sub.shards {
+		select {
+		case sh.subs <- sub:
+			sent++
+			continue
+		case <-srv.done:
+			err = ErrServerClosed
+		}
+		break
+	}
+	accepted := 0
+	for i := 0; i < sent; i++ {
+		if e := <-sub.registered; e != nil {
+			err = e
+		} else {
+			accepted++
+		}
+	}
+	return accepted, err
+}
+
+// Safe to call after the server has been closed
+func (srv *Server) unsubscribe(sub *subscription) {
+	for _, sh := range sub.shards {
+		select {
+		case sh.unregister <- sub:
+		case <-srv.done:
+		}
+	}
+}
+
+// Register the repository to be used for the specified channel. A nil repository deregisters the channel.
+// If the repository implements Storer, the events published to the channel from now on are stored in it.
 func (srv *Server) Register(channel string, repo Repository) {
-	srv.registrations <- &registration{
+	select {
+	case srv.owner(channel).registrations <- &registration{
 		channel:    channel,
 		repository: repo,
+	}:
+	case <-srv.closed:
 	}
 }
 
-// Publish an event with the specified id to one or more channels
+// Stop using a repository for the specified channel, so that it can be garbage collected.
+// Clients already subscribed are unaffected, and those subscribing afterwards won't have events replayed.
+func (srv *Server) Deregister(channel string) {
+	srv.Register(channel, nil)
+}
+
+// Reports whether a repository is registered for the channel, so that events
+// published to it can be replayed to clients which reconnect
+func (srv *Server) HasRepository(channel string) bool {
+	req := &repositoryLookup{
+		channel: channel,
+		found:   make(chan bool),
+	}
+	select {
+	case srv.owner(channel).lookups <- req:
+		return <-req.found
+	case <-srv.closed:
+		return false
+	}
+}
+
+// Disconnect the channel's subscribers, once they've been sent any events
+// still queued for them, and stop using its repository, leaving the other
+// channels running. Subscribers to several channels, through MultiHandler,
+// are disconnected from all of them. Clients may subscribe to the channel
+// again afterwards.
+func (srv *Server) CloseChannel(channel string) {
+	select {
+	case srv.owner(channel).closings <- channel:
+	case <-srv.closed:
+	}
+}
+
+// Publish an event with the specified id to one or more channels. Once the
+// server is closed the event is discarded; PublishContext reports that.
 func (srv *Server) Publish(channels []string, ev Event) {
-	srv.pub <- &outbound{
-		channels: channels,
-		event:    ev,
+	for sh, part := range srv.split(channels) {
+		select {
+		case sh.pub <- &outbound{
+			channels: part,
+			event:    ev,
+		}:
+		case <-srv.closed:
+			return
+		}
+	}
+	srv.tapped(TappedEvent{Channels: channels, Event: ev})
+}
+
+// Publish an event like Publish, but give up waiting for the server to
+// accept it when the context is done, returning the context's error.
+// Publishing waits while the server is busy, for instance for a full
+// subscriber queue within the SendTimeout, so this lets a producer slow
+// down without blocking indefinitely. An error is also returned if the
+// server has been closed. With more than one of the Shards, the event may
+// already have been published to some of the channels when giving up.
+func (srv *Server) PublishContext(ctx context.Context, channels []string, ev Event) error {
+	for sh, part := range srv.split(channels) {
+		select {
+		case sh.pub <- &outbound{channels: part, event: ev}:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-srv.closed:
+			return ErrServerClosed
+		}
+	}
+	srv.tapped(TappedEvent{Channels: channels, Event: ev})
+	return nil
+}
+
+// Publish an event to the single subscriber with the specified id, as given
+// by SubscriptionID, whichever channels it is subscribed to. The event is
+// discarded if there's no such subscriber.
+func (srv *Server) PublishTo(subID string, ev Event) {
+	// Only the shard which has the subscriber sends it the event
+	for _, sh := range srv.start() {
+		select {
+		case sh.unicasts <- &unicast{
+			id:    subID,
+			event: ev,
+		}:
+		case <-srv.closed:
+			return
+		}
+	}
+	srv.tapped(TappedEvent{SubscriptionID: subID, Event: ev})
+}
+
+// Publish an event like Publish, returning the number of subscribers it was
+// queued for. A subscriber to several of the channels is counted for each.
+// Subscribers dropped for not keeping up aren't counted, and nobody is
+// counted once the server is closed.
+func (srv *Server) PublishCount(channels []string, ev Event) int {
+	parts := srv.split(channels)
+	queued := make(chan int, len(parts))
+	sent := 0
+	for sh, part := range parts {
+		select {
+		case sh.pub <- &outbound{
+			channels: part,
+			event:    ev,
+			queued:   queued,
+		}:
+			sent++
+		case <-srv.closed:
+		}
 	}
+	if sent == len(parts) {
+		srv.tapped(TappedEvent{Channels: channels, Event: ev})
+	}
+	count := 0
+	for i := 0; i < sent; i++ {
+		count += <-queued
+	}
+	return count
+}
+
+// Publish an event to every subscriber, whichever channel they are subscribed to
+func (srv *Server) Broadcast(ev Event) {
+	for _, sh := range srv.start() {
+		select {
+		case sh.broadcasts <- ev:
+		case <-srv.closed:
+			return
+		}
+	}
+	srv.tapped(TappedEvent{Event: ev})
+}
+
+// A copy of a published event, as received from Tap
+type TappedEvent struct {
+	// The channels it was published to, or nil if it was broadcast or sent
+	// with PublishTo
+	Channels []string
+	// The subscription it was sent to with PublishTo, if it was
+	SubscriptionID string
+	Event          Event
+}
+
+// Marshals the event as an object holding its channels or subscription, id,
+// name and data, so that a tap can be written as lines of JSON with a
+// json.Encoder
+func (t TappedEvent) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Channels     []string `json:"channels,omitempty"`
+		Subscription string   `json:"subscription,omitempty"`
+		Id           string   `json:"id,omitempty"`
+		Event        string   `json:"event,omitempty"`
+		Data         string   `json:"data"`
+	}{t.Channels, t.SubscriptionID, t.Event.Id(), t.Event.Event(), t.Event.Data()})
+}
+
+// Tap returns a channel receiving a copy of every event published, broadcast
+// or sent with PublishTo from now on, for instance to inspect or log them,
+// and a function to stop tapping which closes the channel. Events are dropped
+// rather than held up when the tap isn't keeping up, so it can't affect
+// subscribers.
+func (srv *Server) Tap() (<-chan TappedEvent, func()) {
+	tap := make(chan TappedEvent, defaultSubscriberBufferSize)
+	srv.tapMu.Lock()
+	defer srv.tapMu.Unlock()
+	// The taps are closed along with the server
+	if srv.taps == nil {
+		close(tap)
+		return tap, func() {}
+	}
+	srv.taps[tap] = struct{}{}
+	return tap, func() {
+		srv.tapMu.Lock()
+		defer srv.tapMu.Unlock()
+		if _, ok := srv.taps[tap]; ok {
+			delete(srv.taps, tap)
+			close(tap)
+		}
+	}
+}
+
+// Sends a copy of an event which has been handed to the shards to each tap
+func (srv *Server) tapped(ev TappedEvent) {
+	srv.tapMu.RLock()
+	defer srv.tapMu.RUnlock()
+	for tap := range srv.taps {
+		select {
+		case tap <- ev:
+		default:
+		}
+	}
+}
+
+// Return the number of clients currently subscribed to the specified channel
+func (srv *Server) SubscriberCount(channel string) int {
+	req := &subscriberCount{
+		channel: channel,
+		count:   make(chan int),
+	}
+	select {
+	case srv.owner(channel).counts <- req:
+		return <-req.count
+	case <-srv.closed:
+		return 0
+	}
+}
+
+// Return the channels which currently have at least one subscriber, in sorted order
+func (srv *Server) Channels() []string {
+	channels := []string{}
+	for _, sh := range srv.start() {
+		reply := make(chan []string)
+		select {
+		case sh.listings <- reply:
+			channels = append(channels, <-reply...)
+		case <-srv.closed:
+			return []string{}
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// Return a snapshot of the current subscriptions, oldest first, for instance
+// to show who's connected in an operations console. Each is gathered from
+// the shards in turn, so one which comes or goes meanwhile may be missed.
+func (srv *Server) Subscriptions() []SubscriptionInfo {
+	infos := []SubscriptionInfo{}
+	for _, sh := range srv.start() {
+		reply := make(chan []SubscriptionInfo)
+		select {
+		case sh.inspections <- reply:
+			infos = append(infos, <-reply...)
+		case <-srv.closed:
+			return []SubscriptionInfo{}
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if !infos[i].ConnectedAt.Equal(infos[j].ConnectedAt) {
+			return infos[i].ConnectedAt.Before(infos[j].ConnectedAt)
+		}
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+// An event with its id or name replaced by the server
+type relabelledEvent struct {
+	ev        Event
+	id, event string
+	// The channel it was published to, if it has been tagged by MultiHandler
+	channel string
+}
+
+func (r *relabelledEvent) Id() string    { return r.id }
+func (r *relabelledEvent) Event() string { return r.event }
+func (r *relabelledEvent) Data() string  { return r.ev.Data() }
+
+func (r *relabelledEvent) WriteData(w io.Writer) error {
+	if writer, ok := r.ev.(DataWriter); ok {
+		return writer.WriteData(w)
+	}
+	_, err := io.WriteString(w, r.ev.Data())
+	return err
+}
+
+func (r *relabelledEvent) Retry() time.Duration {
+	if retrier, ok := r.ev.(Retrier); ok {
+		return retrier.Retry()
+	}
+	return 0
 }
 
-func replay(repo Repository, sub *subscription) {
-	for ev := range repo.Replay(sub.channel, sub.lastEventId) {
-		sub.out <- ev
+func (srv *Server) stamp(ids map[string]uint64, channel string, ev Event) Event {
+	if !srv.AutoID || len(ev.Id()) > 0 {
+		return ev
 	}
+	ids[channel]++
+	return &relabelledEvent{ev, strconv.FormatUint(ids[channel], 10), ev.Event(), ""}
+}
+
+type presence struct {
+	Channel     string `json:"channel"`
+	Subscribers int    `json:"subscribers"`
+}
+
+// Passes presence events on to the shard running the PresenceChannel, in
+// order, without holding up the shard they come from while it's busy
+func (srv *Server) forward() chan<- Event {
+	events := make(chan Event, defaultSubscriberBufferSize)
+	to := srv.owner(srv.PresenceChannel)
+	go func() {
+		for ev := range events {
+			select {
+			case to.announcements <- ev:
+			case <-to.done:
+			}
+		}
+	}()
+	return events
 }
 
-func (srv *Server) run() {
+func (srv *Server) run(sh *shard) {
+	defer close(sh.done)
 	subs := make(map[string]map[*subscription]struct{})
+	// The patterns among the channels of subs
+	patterns := make(map[string]struct{})
 	repos := make(map[string]Repository)
+	ids := make(map[string]uint64)
+	byID := make(map[string]*subscription)
+	limits := make(map[string]*bucket)
+	var forwarded chan<- Event
+	if len(srv.PresenceChannel) > 0 && srv.owner(srv.PresenceChannel) != sh {
+		forwarded = srv.forward()
+		defer close(forwarded)
+	}
+	// Reports whether the channel is run by this shard
+	mine := func(channel string) bool {
+		return srv.owner(channel) == sh
+	}
+	// Discards what's kept for a channel once it has neither subscribers nor
+	// a repository, so that channels which come and go don't pile up
+	forget := func(channel string) {
+		if _, ok := subs[channel]; ok || repos[channel] != nil {
+			return
+		}
+		delete(ids, channel)
+		delete(limits, channel)
+	}
+	// Reports whether an event can be published to the channel
+	allow := func(channel string) bool {
+		if srv.MaxEventsPerSecond <= 0 {
+			return true
+		}
+		now := srv.clock.Now()
+		b, ok := limits[channel]
+		if !ok || b.rate != srv.MaxEventsPerSecond {
+			b = newBucket(srv.MaxEventsPerSecond, now)
+			limits[channel] = b
+		}
+		wait := b.take(now)
+		if wait == 0 {
+			return true
+		}
+		if srv.BlockRateLimited {
+			<-srv.clock.After(wait)
+			// The token which was awaited has now been taken
+			b.tokens, b.last = 0, now.Add(wait)
+			return true
+		}
+		if srv.OnRateLimited != nil {
+			srv.OnRateLimited(channel)
+		}
+		return false
+	}
+	var deliver func(sub *subscription, channel string, ev Event) bool
+	store := func(channel string, ev Event) {
+		if storer, ok := repos[channel].(Storer); ok {
+			if err := storer.Store(channel, ev); err != nil {
+				srv.error(channel, err)
+			}
+		}
+	}
+	// Subscribers to the presence channel itself aren't announced, so that
+	// dropping one while announcing can't lead to another announcement
+	present := func(ev Event) {
+		ev = srv.stamp(ids, srv.PresenceChannel, ev)
+		store(srv.PresenceChannel, ev)
+		for s := range subs[srv.PresenceChannel] {
+			deliver(s, srv.PresenceChannel, ev)
+		}
+		forget(srv.PresenceChannel)
+	}
+	announce := func(name, channel string) {
+		if len(srv.PresenceChannel) == 0 || channel == srv.PresenceChannel {
+			return
+		}
+		data, _ := json.Marshal(presence{channel, len(subs[channel])})
+		ev := &publication{event: name, data: string(data)}
+		if forwarded != nil {
+			forwarded <- ev
+		} else {
+			present(ev)
+		}
+	}
+	// Closing out, once no other shard holds the subscription, lets the
+	// handler send whatever is still queued and then return
+	remove := func(sub *subscription) {
+		var held []string
+		for _, c := range sub.channels {
+			if _, ok := subs[c][sub]; ok {
+				held = append(held, c)
+			}
+		}
+		if len(held) == 0 {
+			return
+		}
+		for _, c := range held {
+			delete(subs[c], sub)
+			if len(subs[c]) == 0 {
+				delete(subs, c)
+				delete(patterns, c)
+				forget(c)
+			}
+			if srv.Metrics != nil && mine(c) {
+				srv.Metrics.SubscriberRemoved(c)
+			}
+		}
+		if byID[sub.id] == sub {
+			delete(byID, sub.id)
+		}
+		if sub.release() {
+			closeQuietly(sub.out)
+		}
+		for _, c := range held {
+			if mine(c) {
+				announce("subscriber-left", c)
+			}
+		}
+	}
+	// Removes a subscription which the handler hasn't unsubscribed, from the
+	// other shards too. They're told in the background, as they may be
+	// waiting on this one.
+	drop := func(sub *subscription) {
+		remove(sub)
+		if len(sub.shards) > 1 {
+			go srv.unsubscribe(sub)
+		}
+	}
+	full := func(sub *subscription) bool {
+		if srv.MaxSubscribersPerChannel <= 0 {
+			return false
+		}
+		for _, c := range sub.channels {
+			if mine(c) && len(subs[c]) >= srv.MaxSubscribersPerChannel {
+				return true
+			}
+		}
+		return false
+	}
+	// It isn't tagged, so that clients recognise it whatever they subscribed to
+	endOfStream := func(sub *subscription) {
+		if srv.SendEndOfStream {
+			srv.send(sub, endOfStream)
+		}
+	}
+	// Returns true if the event was queued for the subscriber
+	deliver = func(sub *subscription, channel string, ev Event) (queued bool) {
+		// A panic, such as from sending on a channel which has been closed
+		// elsewhere, only costs the subscriber rather than the whole server
+		defer func() {
+			if r := recover(); r != nil {
+				srv.error(channel, fmt.Errorf("Eventsource: panic delivering to subscriber: %v", r))
+				drop(sub)
+			}
+		}()
+		key := ""
+		if srv.CoalesceKey != nil {
+			key = srv.CoalesceKey(channel, ev)
+		}
+		ev = sub.tag(channel, ev)
+		if len(key) > 0 {
+			if sub.coalesce(coalesced{channel, key}, ev) {
+				// The event it replaced is the one which won't be delivered
+				if srv.Metrics != nil {
+					srv.Metrics.EventDropped(channel)
+				}
+				return true
+			}
+			ev = coalesced{channel, key}
+		}
+		if srv.send(sub, ev) {
+			if srv.Metrics != nil {
+				srv.Metrics.EventDelivered(channel)
+			}
+			return true
+		}
+		// The subscriber isn't keeping up
+		if srv.Metrics != nil {
+			srv.Metrics.EventDropped(channel)
+		}
+		drop(sub)
+		return false
+	}
 	for {
 		select {
-		case reg := <-srv.registrations:
-			repos[reg.channel] = reg.repository
-		case sub := <-srv.unregister:
-			delete(subs[sub.channel], sub)
-		case pub := <-srv.pub:
+		case reg := <-sh.registrations:
+			if reg.repository == nil {
+				delete(repos, reg.channel)
+				forget(reg.channel)
+			} else {
+				repos[reg.channel] = reg.repository
+			}
+		case sub := <-sh.unregister:
+			remove(sub)
+		case channel := <-sh.closings:
+			for s := range subs[channel] {
+				endOfStream(s)
+				drop(s)
+			}
+			delete(repos, channel)
+			forget(channel)
+		case uni := <-sh.unicasts:
+			if sub, ok := byID[uni.id]; ok && !srv.send(sub, uni.event) {
+				drop(sub)
+			}
+		case ev := <-sh.announcements:
+			present(ev)
+		case req := <-sh.counts:
+			req.count <- len(subs[req.channel])
+		case req := <-sh.lookups:
+			_, ok := repos[req.channel]
+			req.found <- ok
+		case reply := <-sh.inspections:
+			var infos []SubscriptionInfo
+			seen := make(map[*subscription]struct{})
+			for _, held := range subs {
+				for s := range held {
+					// Only one shard reports each subscription
+					if _, ok := seen[s]; ok || s.shards[0] != sh {
+						continue
+					}
+					seen[s] = struct{}{}
+					infos = append(infos, SubscriptionInfo{
+						ID:              s.id,
+						Channels:        append([]string(nil), s.channels...),
+						RemoteAddr:      s.remoteAddr,
+						ConnectedAt:     s.connectedAt,
+						LastEventID:     s.lastEventID,
+						EventsDelivered: s.delivered.Load(),
+						Queued:          len(s.out),
+					})
+				}
+			}
+			reply <- infos
+		case reply := <-sh.listings:
+			channels := make([]string, 0, len(subs))
+			for channel := range subs {
+				// Every shard holds the patterns
+				if mine(channel) {
+					channels = append(channels, channel)
+				}
+			}
+			sort.Strings(channels)
+			reply <- channels
+		case pub := <-sh.pub:
+			queued := 0
 			for _, c := range pub.channels {
+				if !allow(c) {
+					continue
+				}
+				if srv.Metrics != nil {
+					srv.Metrics.EventPublished(c)
+				}
+				ev := srv.stamp(ids, c, pub.event)
+				store(c, ev)
+				for s := range subs[c] {
+					if deliver(s, c, ev) {
+						queued++
+					}
+				}
+				// Subscribers to several matching channels are sent it once
+				var matched map[*subscription]struct{}
+				for p := range patterns {
+					if p == c || !matchChannel(p, c) {
+						continue
+					}
+					for s := range subs[p] {
+						if _, ok := subs[c][s]; ok {
+							continue
+						}
+						if _, ok := matched[s]; ok {
+							continue
+						}
+						if matched == nil {
+							matched = make(map[*subscription]struct{})
+						}
+						matched[s] = struct{}{}
+						if deliver(s, c, ev) {
+							queued++
+						}
+					}
+				}
+				// Nor is anything kept for a channel nobody heard it on
+				if matched == nil {
+					forget(c)
+				}
+			}
+			if pub.queued != nil {
+				pub.queued <- queued
+			}
+		case ev := <-sh.broadcasts:
+			// Channels with nobody subscribed still keep it in their history
+			channels := make(map[string]struct{}, len(subs))
+			for c := range subs {
+				if mine(c) {
+					channels[c] = struct{}{}
+				}
+			}
+			for c, repo := range repos {
+				if _, ok := repo.(Storer); ok {
+					channels[c] = struct{}{}
+				}
+			}
+			for c := range channels {
+				if !allow(c) {
+					continue
+				}
+				if srv.Metrics != nil {
+					srv.Metrics.EventPublished(c)
+				}
+				ev := srv.stamp(ids, c, ev)
+				store(c, ev)
 				for s := range subs[c] {
-					s.out <- pub.event
+					deliver(s, c, ev)
+				}
+			}
+		case sub := <-sh.subs:
+			if full(sub) {
+				sub.release()
+				sub.registered <- errChannelFull
+				continue
+			}
+			for i, c := range sub.channels {
+				if isPattern(c) {
+					patterns[c] = struct{}{}
+				} else if !mine(c) {
+					continue
+				}
+				if _, ok := subs[c]; !ok {
+					subs[c] = make(map[*subscription]struct{})
+				}
+				subs[c][sub] = struct{}{}
+				// The shard running a pattern accounts for its subscribers
+				if !mine(c) {
+					continue
+				}
+				if srv.Metrics != nil {
+					srv.Metrics.SubscriberAdded(c)
+				}
+				if (len(sub.lastEventId(i)) > 0 || srv.ReplayAll || sub.replaysSince(repos[c])) && !srv.DisableReplay {
+					sub.repositories[i] = repos[c]
 				}
 			}
-		case sub := <-srv.subs:
-			if _, ok := subs[sub.channel]; !ok {
-				subs[sub.channel] = make(map[*subscription]struct{})
+			// Only one shard sends the subscriber events from PublishTo
+			if len(sub.id) > 0 && sub.shards[0] == sh {
+				byID[sub.id] = sub
 			}
-			subs[sub.channel][sub] = struct{}{}
-			if len(sub.lastEventId) > 0 {
-				repo, ok := repos[sub.channel]
-				if ok {
-					go replay(repo, sub)
+			srv.handlers.Add(1)
+			sub.registered <- nil
+			for _, c := range sub.channels {
+				if mine(c) {
+					announce("subscriber-joined", c)
 				}
 			}
-		case <-srv.quit:
+		case <-sh.quit:
+			// A subscription to several channels must only be released once,
+			// and closed by whichever shard holds it last
+			released := make(map[*subscription]struct{})
 			for _, sub := range subs {
 				for s := range sub {
-					close(s.out)
+					if _, ok := released[s]; !ok {
+						released[s] = struct{}{}
+						if s.release() {
+							endOfStream(s)
+							close(s.out)
+						}
+					}
 				}
 			}
 			return
 		}
 	}
 }
+
+// Returns false if the subscriber's queue stays full for longer than the SendTimeout
+func (srv *Server) send(sub *subscription, ev Event) bool {
+	select {
+	case sub.out <- ev:
+		return true
+	default:
+	}
+	if srv.SendTimeout <= 0 {
+		return false
+	}
+	select {
+	case sub.out <- ev:
+		return true
+	case <-srv.clock.After(srv.SendTimeout):
+		return false
+	}
+}
+
+// The channel may already be closed, by whatever made delivery panic
+func closeQuietly(out chan Event) {
+	defer func() { recover() }()
+	close(out)
+}
+
+func acceptsGzip(req *http.Request) bool {
+	for _, coding := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(coding, ";")
+		if strings.TrimSpace(params[0]) != "gzip" {
+			continue
+		}
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if q, err := strconv.ParseFloat(value, 64); name == "q" && err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Reports whether the request's Accept header includes the media type.
+// Wildcards aren't enough, as they're sent by clients which aren't expecting a stream.
+func accepts(req *http.Request, mediaType string) bool {
+	for _, accept := range req.Header.Values("Accept") {
+		for _, media := range strings.Split(accept, ",") {
+			params := strings.Split(media, ";")
+			if !strings.EqualFold(strings.TrimSpace(params[0]), mediaType) {
+				continue
+			}
+			for _, param := range params[1:] {
+				name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if q, err := strconv.ParseFloat(value, 64); name == "q" && err == nil && q == 0 {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether w, or a ResponseWriter it wraps, supports flushing
+func canFlush(w http.ResponseWriter) bool {
+	for {
+		switch t := w.(type) {
+		case http.Flusher, interface{ FlushError() error }:
+			return true
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = t.Unwrap()
+		default:
+			return false
+		}
+	}
+}
+
+// Sets a write deadline, if there's a timeout, before each write and flush
+type deadlineWriter struct {
+	w       io.Writer
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func (dw *deadlineWriter) deadline() {
+	if dw.timeout > 0 {
+		dw.rc.SetWriteDeadline(time.Now().Add(dw.timeout))
+	}
+}
+
+func (dw *deadlineWriter) Write(p []byte) (int, error) {
+	dw.deadline()
+	return dw.w.Write(p)
+}
+
+func (dw *deadlineWriter) Flush() {
+	dw.deadline()
+	dw.rc.Flush()
+}
+
+// Compresses the stream, pushing out any buffered data on each flush so
+// that events aren't delayed.
+type gzipWriter struct {
+	*gzip.Writer
+	flusher http.Flusher
+}
+
+func (gz *gzipWriter) Flush() {
+	gz.Writer.Flush()
+	gz.flusher.Flush()
+}
@@ -0,0 +1,2040 @@
+package eventsource
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func subscribe(t *testing.T, url string, header http.Header) (*Decoder, func()) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewDecoder(resp.Body), func() { resp.Body.Close() }
+}
+
+// Subscribe to a channel directly, bypassing the handler
+func register(t testing.TB, srv *Server, channel string, size int) *subscription {
+	sub := &subscription{
+		channels: []string{channel},
+		out:      make(chan Event, size),
+	}
+	if _, err := srv.add(sub); err != nil {
+		t.Fatal(err)
+	}
+	return sub
+}
+
+func expectEvents(t *testing.T, dec *Decoder, ids ...string) {
+	for _, want := range ids {
+		ev, err := dec.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.Id() != want {
+			t.Errorf("Expected id: %s Got: %s", want, ev.Id())
+		}
+	}
+}
+
+func TestLastEventIdFallback(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	repo := NewSliceRepository()
+	for _, id := range []string{"1", "2", "3"} {
+		repo.Add("test", &testEvent{id, "", "replayed"})
+	}
+	srv.Register("test", repo)
+	ts := httptest.NewServer(srv.Handler("test"))
+	defer ts.Close()
+
+	dec, done := subscribe(t, ts.URL, http.Header{"Last-Event-Id": {"2"}})
+	expectEvents(t, dec, "2", "3")
+	done()
+
+	dec, done = subscribe(t, ts.URL+"?lastEventId=2", nil)
+	expectEvents(t, dec, "2", "3")
+	done()
+
+	dec, done = subscribe(t, ts.URL+"?lastEventId=1", http.Header{"Last-Event-Id": {"2"}})
+	expectEvents(t, dec, "2", "3")
+	done()
+
+	srv.LastEventIdParam = "since"
+	dec, done = subscribe(t, ts.URL+"?since=3", nil)
+	expectEvents(t, dec, "3")
+	done()
+}
+
+func TestSlowSubscriberDropped(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	sub := register(t, srv, "test", 1)
+	for _, id := range []string{"1", "2", "3"} {
+		srv.Publish([]string{"test"}, &testEvent{id, "", "queued"})
+	}
+	if ev := <-sub.out; ev.Id() != "1" {
+		t.Errorf("Expected id: 1 Got: %s", ev.Id())
+	}
+	if _, ok := <-sub.out; ok {
+		t.Error("Expected slow subscriber to be dropped")
+	}
+	if n := srv.SubscriberCount("test"); n != 0 {
+		t.Errorf("Expected no subscribers Got: %d", n)
+	}
+}
+
+func TestSubscriberCount(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	if channels := srv.Channels(); channels == nil || len(channels) != 0 {
+		t.Errorf("Expected no channels Got: %#v", channels)
+	}
+	news := []*subscription{register(t, srv, "news", 1), register(t, srv, "news", 1)}
+	sport := register(t, srv, "sport", 1)
+	for channel, want := range map[string]int{"news": 2, "sport": 1, "weather": 0} {
+		if n := srv.SubscriberCount(channel); n != want {
+			t.Errorf("Expected %d subscribers to %s Got: %d", want, channel, n)
+		}
+	}
+	if channels := srv.Channels(); !reflect.DeepEqual(channels, []string{"news", "sport"}) {
+		t.Errorf("Expected: [news sport] Got: %v", channels)
+	}
+	srv.unsubscribe(sport)
+	srv.unsubscribe(news[0])
+	if n := srv.SubscriberCount("news"); n != 1 {
+		t.Errorf("Expected 1 subscriber to news Got: %d", n)
+	}
+	if channels := srv.Channels(); !reflect.DeepEqual(channels, []string{"news"}) {
+		t.Errorf("Expected: [news] Got: %v", channels)
+	}
+}
+
+func TestSendTimeout(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.SendTimeout = 50 * time.Millisecond
+	draining := register(t, srv, "test", 1)
+	stalled := register(t, srv, "test", 1)
+	go func() {
+		for range draining.out {
+		}
+	}()
+	start := time.Now()
+	for _, id := range []string{"1", "2"} {
+		srv.Publish([]string{"test"}, &testEvent{id, "", "queued"})
+	}
+	if n := srv.SubscriberCount("test"); n != 1 {
+		t.Errorf("Expected 1 subscriber Got: %d", n)
+	}
+	if elapsed := time.Since(start); elapsed < srv.SendTimeout {
+		t.Errorf("Expected publish to wait for %s Got: %s", srv.SendTimeout, elapsed)
+	}
+	if ev := <-stalled.out; ev.Id() != "1" {
+		t.Errorf("Expected id: 1 Got: %s", ev.Id())
+	}
+	if _, ok := <-stalled.out; ok {
+		t.Error("Expected stalled subscriber to be dropped")
+	}
+}
+
+type unauthorized struct{ error }
+
+func (unauthorized) StatusCode() int { return http.StatusUnauthorized }
+
+func TestAuthorize(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.Authorize = func(channel string, r *http.Request) error {
+		switch r.Header.Get("Authorization") {
+		case "":
+			return unauthorized{errors.New("no credentials")}
+		case "Bearer secret":
+			return nil
+		}
+		return errors.New("bad credentials")
+	}
+	ts := httptest.NewServer(srv.Handler("test"))
+	defer ts.Close()
+	for auth, status := range map[string]int{"": http.StatusUnauthorized, "Bearer guess": http.StatusForbidden} {
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		req.Header.Set("Authorization", auth)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("Expected status: %d Got: %d", status, resp.StatusCode)
+		}
+		if n := srv.SubscriberCount("test"); n != 0 {
+			t.Errorf("Expected no subscribers Got: %d", n)
+		}
+	}
+	dec, done := subscribe(t, ts.URL, http.Header{"Authorization": {"Bearer secret"}})
+	defer done()
+	srv.Publish([]string{"test"}, &testEvent{"1", "", "authorized"})
+	expectEvents(t, dec, "1")
+}
+
+func TestAutoID(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.AutoID = true
+	subs := []*subscription{register(t, srv, "a", 8), register(t, srv, "b", 8)}
+	srv.Publish([]string{"a"}, &testEvent{"", "", "first"})
+	srv.Publish([]string{"a", "b"}, &testEvent{"", "", "second"})
+	srv.Publish([]string{"a"}, &testEvent{"custom", "", "third"})
+	srv.Broadcast(&testEvent{"", "", "fourth"})
+	for i, want := range [][]string{{"1", "2", "custom", "3"}, {"1", "2"}} {
+		for _, id := range want {
+			if ev := <-subs[i].out; ev.Id() != id {
+				t.Errorf("Expected id: %s Got: %s", id, ev.Id())
+			}
+		}
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	repo := storingRepository{NewSliceRepository()}
+	srv.Register("archive", repo)
+	subs := []*subscription{
+		register(t, srv, "news", 4),
+		register(t, srv, "news", 4),
+		register(t, srv, "sport", 4),
+		register(t, srv, "orders.1", 4),
+		// Matches orders.1 too, but is only sent the event once
+		register(t, srv, "orders.*", 4),
+	}
+	slow := register(t, srv, "weather", 1)
+	srv.Broadcast(&testEvent{"1", "update", "first"})
+	srv.Broadcast(&testEvent{"2", "update", "second"})
+	// Waits for the broadcasts to have been delivered
+	if n := srv.SubscriberCount("weather"); n != 0 {
+		t.Errorf("Expected the slow subscriber to be dropped Got: %d subscribers", n)
+	}
+	for i, sub := range subs {
+		for _, want := range []string{"1", "2"} {
+			if ev := <-sub.out; ev.Id() != want {
+				t.Errorf("Subscriber %d Expected id: %s Got: %s", i, want, ev.Id())
+			}
+		}
+		if n := len(sub.out); n != 0 {
+			t.Errorf("Subscriber %d Expected each event once Got: %d more", i, n)
+		}
+	}
+	if ev := <-slow.out; ev.Id() != "1" {
+		t.Errorf("Expected id: 1 Got: %s", ev.Id())
+	}
+	if _, ok := <-slow.out; ok {
+		t.Error("Expected slow subscriber to be dropped")
+	}
+	// Stored although nobody is subscribed to the channel
+	expectReplay(t, repo, "archive", "", "1", "2")
+}
+
+func TestAutoIDForgotten(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.AutoID = true
+	// Publishes an event to the channel, returning the id it was given
+	next := func(channel string) string {
+		sub := register(t, srv, channel, 1)
+		defer srv.unsubscribe(sub)
+		srv.Publish([]string{channel}, &testEvent{"", "", "counted"})
+		return (<-sub.out).Id()
+	}
+	// Each time the last subscriber leaves, the counter starts again
+	for i := 0; i < 2; i++ {
+		if id := next("a"); id != "1" {
+			t.Errorf("Expected id: 1 Got: %s", id)
+		}
+	}
+	// Unless there's a repository
+	srv.Register("b", NewSliceRepository())
+	for _, want := range []string{"1", "2"} {
+		if id := next("b"); id != want {
+			t.Errorf("Expected id: %s Got: %s", want, id)
+		}
+	}
+	// Subscribers keep the counter going after deregistering
+	sub := register(t, srv, "b", 2)
+	srv.Deregister("b")
+	srv.Publish([]string{"b"}, &testEvent{"", "", "counted"})
+	if id := (<-sub.out).Id(); id != "3" {
+		t.Errorf("Expected id: 3 Got: %s", id)
+	}
+	srv.unsubscribe(sub)
+	if id := next("b"); id != "1" {
+		t.Errorf("Expected id: 1 Got: %s", id)
+	}
+	srv.Register("c", NewSliceRepository())
+	next("c")
+	srv.CloseChannel("c")
+	if id := next("c"); id != "1" {
+		t.Errorf("Expected id: 1 Got: %s", id)
+	}
+	// Nor is a counter kept for a channel published to with nobody subscribed
+	for i := 0; i < 3; i++ {
+		srv.Publish([]string{"d"}, &testEvent{"", "", "unheard"})
+	}
+	if id := next("d"); id != "1" {
+		t.Errorf("Expected id: 1 Got: %s", id)
+	}
+	// Unless a pattern subscriber hears it
+	pattern := register(t, srv, "*", 4)
+	for _, want := range []string{"1", "2"} {
+		srv.Publish([]string{"e"}, &testEvent{"", "", "overheard"})
+		if id := (<-pattern.out).Id(); id != want {
+			t.Errorf("Expected id: %s Got: %s", want, id)
+		}
+	}
+}
+
+func TestMaxSubscribersPerChannel(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.MaxSubscribersPerChannel = 2
+	ts := httptest.NewServer(srv.Handler("test"))
+	defer ts.Close()
+	for i := 0; i < srv.MaxSubscribersPerChannel; i++ {
+		_, done := subscribe(t, ts.URL, nil)
+		defer done()
+	}
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected status: %d Got: %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+	if n := srv.SubscriberCount("test"); n != srv.MaxSubscribersPerChannel {
+		t.Errorf("Expected %d subscribers Got: %d", srv.MaxSubscribersPerChannel, n)
+	}
+}
+
+// A ResponseWriter which can't be written to, as if the client had gone
+type brokenWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (brokenWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestSubscribeHooks(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// Prepares the server before the client subscribes
+		setup func(t *testing.T, srv *Server)
+		// Ends the subscription by the route being tested, if it's accepted
+		end    func(srv *Server, cancel context.CancelFunc)
+		broken bool
+		want   int32
+	}{
+		{"client disconnect", nil, func(srv *Server, cancel context.CancelFunc) { cancel() }, false, 1},
+		{"server close", nil, func(srv *Server, cancel context.CancelFunc) { srv.Close() }, false, 1},
+		{"write error", nil, func(srv *Server, cancel context.CancelFunc) {
+			srv.Publish([]string{"test"}, &testEvent{"1", "", "unwritable"})
+		}, true, 1},
+		{"unauthorized", func(t *testing.T, srv *Server) {
+			srv.Authorize = func(string, *http.Request) error { return errors.New("not allowed") }
+		}, nil, false, 0},
+		{"channel full", func(t *testing.T, srv *Server) {
+			srv.MaxSubscribersPerChannel = 1
+			register(t, srv, "test", 1)
+		}, nil, false, 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			srv := NewServer()
+			defer srv.Close()
+			var subscribed, unsubscribed atomic.Int32
+			srv.OnSubscribe = func(string, *http.Request) { subscribed.Add(1) }
+			srv.OnUnsubscribe = func(string) { unsubscribed.Add(1) }
+			srv.OnError = func(string, error) {}
+			if test.setup != nil {
+				test.setup(t, srv)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+			var w http.ResponseWriter = httptest.NewRecorder()
+			if test.broken {
+				w = brokenWriter{httptest.NewRecorder()}
+			}
+			finished := make(chan struct{})
+			go func() {
+				defer close(finished)
+				srv.Handler("test")(w, req)
+			}()
+			if test.end != nil {
+				for subscribed.Load() == 0 {
+					time.Sleep(time.Millisecond)
+				}
+				test.end(srv, cancel)
+			}
+			<-finished
+			if n := subscribed.Load(); n != test.want {
+				t.Errorf("Expected OnSubscribe to be called %d times Got: %d", test.want, n)
+			}
+			if n := unsubscribed.Load(); n != test.want {
+				t.Errorf("Expected OnUnsubscribe to be called %d times Got: %d", test.want, n)
+			}
+		})
+	}
+}
+
+func TestErrorReporting(t *testing.T) {
+	var std bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&std)
+	for _, sink := range []string{"OnError", "ErrorLog", "log"} {
+		t.Run(sink, func(t *testing.T) {
+			std.Reset()
+			srv := NewServer()
+			defer srv.Close()
+			var reported, logged bytes.Buffer
+			switch sink {
+			case "OnError":
+				srv.OnError = func(channel string, err error) {
+					fmt.Fprintf(&reported, "%s: %s", channel, err)
+				}
+				srv.ErrorLog = log.New(&logged, "", 0)
+			case "ErrorLog":
+				srv.ErrorLog = log.New(&logged, "", 0)
+			}
+			finished := make(chan struct{})
+			go func() {
+				defer close(finished)
+				srv.Handler("test")(brokenWriter{httptest.NewRecorder()}, httptest.NewRequest("GET", "/", nil))
+			}()
+			for srv.SubscriberCount("test") == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			srv.Publish([]string{"test"}, &testEvent{"1", "", "unwritable"})
+			<-finished
+			for name, got := range map[string]string{
+				"OnError":  reported.String(),
+				"ErrorLog": logged.String(),
+				"log":      std.String(),
+			} {
+				if name == sink && !strings.Contains(got, "broken pipe") {
+					t.Errorf("Expected the write error to be reported to %s Got: %q", name, got)
+				} else if name != sink && len(got) > 0 {
+					t.Errorf("Expected nothing reported to %s Got: %q", name, got)
+				}
+			}
+			if sink == "OnError" && !strings.HasPrefix(reported.String(), "test: ") {
+				t.Errorf("Expected the error to be reported for the channel Got: %q", reported.String())
+			}
+		})
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	srv := NewServer()
+	ts := httptest.NewServer(srv.Handler("test"))
+	defer ts.Close()
+	dec, done := subscribe(t, ts.URL, nil)
+	defer done()
+	for _, id := range []string{"1", "2", "3"} {
+		srv.Publish([]string{"test"}, &testEvent{id, "", "in flight"})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expectEvents(t, dec, "1", "2", "3")
+	if _, err := dec.Decode(); err != io.EOF {
+		t.Errorf("Expected: %s Got: %v", io.EOF, err)
+	}
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected status: %d Got: %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	srv := NewServer()
+	// Registered directly, so no handler will ever finish for it
+	register(t, srv, "test", 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected: %s Got: %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestFilteredHandler(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	repo := NewSliceRepository()
+	repo.Add("test", &testEvent{"1", "odd", "replayed"})
+	repo.Add("test", &testEvent{"2", "even", "replayed"})
+	srv.Register("test", repo)
+	ts := httptest.NewServer(srv.FilteredHandler("test", func(ev Event) bool {
+		return ev.Event() == "odd"
+	}))
+	defer ts.Close()
+	dec, done := subscribe(t, ts.URL, http.Header{"Last-Event-Id": {"1"}})
+	defer done()
+	srv.Publish([]string{"test"}, &testEvent{"4", "even", "live"})
+	srv.Publish([]string{"test"}, &testEvent{"3", "odd", "live"})
+	expectEvents(t, dec, "1", "3")
+}
+
+func TestResync(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	repo := NewRingBufferRepository(2)
+	for _, id := range []string{"1", "2", "3"} {
+		repo.Add("test", &testEvent{id, "", "replayed"})
+	}
+	srv.Register("test", repo)
+	ts := httptest.NewServer(srv.Handler("test"))
+	defer ts.Close()
+	dec, done := subscribe(t, ts.URL, http.Header{"Last-Event-Id": {"1"}})
+	defer done()
+	ev, err := dec.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Event() != ResyncEvent || ev.Data() != "1" {
+		t.Errorf("Expected: %s 1 Got: %s %s", ResyncEvent, ev.Event(), ev.Data())
+	}
+	expectEvents(t, dec, "2", "3")
+}
+
+func TestPresenceChannel(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.PresenceChannel = "presence"
+	watcher := register(t, srv, "presence", 8)
+	first := register(t, srv, "test", 8)
+	register(t, srv, "test", 8)
+	srv.unsubscribe(first)
+	for _, want := range []string{
+		`subscriber-joined {"channel":"test","subscribers":1}`,
+		`subscriber-joined {"channel":"test","subscribers":2}`,
+		`subscriber-left {"channel":"test","subscribers":1}`,
+	} {
+		if ev := <-watcher.out; ev.Event()+" "+ev.Data() != want {
+			t.Errorf("Expected: %s Got: %s %s", want, ev.Event(), ev.Data())
+		}
+	}
+	select {
+	case ev := <-watcher.out:
+		t.Errorf("Unexpected event: %s %s", ev.Event(), ev.Data())
+	default:
+	}
+}
+
+func TestMultiHandler(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv.MultiHandler([]string{"news", "sport"}))
+	defer ts.Close()
+	dec, done := subscribe(t, ts.URL, nil)
+	for srv.SubscriberCount("sport") != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	srv.Publish([]string{"news"}, &testEvent{"1", "", "headline"})
+	srv.Publish([]string{"weather"}, &testEvent{"2", "", "rain"})
+	srv.Publish([]string{"sport"}, &testEvent{"3", "score", "1-0"})
+	for _, want := range []string{"news news=1", "sport:score news=1&sport=3"} {
+		ev, err := dec.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ev.Event() + " " + ev.Id(); got != want {
+			t.Errorf("Expected: %s Got: %s", want, got)
+		}
+	}
+	done()
+	for srv.SubscriberCount("news")+srv.SubscriberCount("sport") != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if channels := srv.Channels(); len(channels) != 0 {
+		t.Errorf("Expected no channels Got: %v", channels)
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.Shards = 4
+	ts := httptest.NewServer(srv.MultiHandler([]string{"a", "b", "c"}))
+	defer ts.Close()
+	dec, done := subscribe(t, ts.URL, http.Header{"Last-Event-Id": {"a=1"}})
+	defer done()
+	for srv.SubscriberCount("a") != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	srv.Publish([]string{"a"}, &testEvent{"2", "", "first"})
+	srv.Publish([]string{"b"}, &testEvent{"1", "", "second"})
+	dec.Decode()
+	dec.Decode()
+	infos := srv.Subscriptions()
+	if len(infos) != 1 {
+		t.Fatalf("Expected 1 subscription Got: %+v", infos)
+	}
+	info := infos[0]
+	if len(info.ID) == 0 || len(info.RemoteAddr) == 0 || info.ConnectedAt.IsZero() {
+		t.Errorf("Expected the subscription's details Got: %+v", info)
+	}
+	if !reflect.DeepEqual(info.Channels, []string{"a", "b", "c"}) || info.LastEventID != "a=1" || info.EventsDelivered != 2 {
+		t.Errorf("Expected channels [a b c], last event id a=1 and 2 events delivered Got: %+v", info)
+	}
+	// The snapshot is a copy
+	info.Channels[0] = "changed"
+	if channels := srv.Subscriptions()[0].Channels; channels[0] != "a" {
+		t.Errorf("Expected the subscription to be unchanged Got: %v", channels)
+	}
+	done()
+	for len(srv.Subscriptions()) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMatchChannel(t *testing.T) {
+	for _, tt := range []struct {
+		pattern, channel string
+		match            bool
+	}{
+		{"orders.*", "orders.123", true},
+		{"orders.*", "orders", false},
+		{"orders.*", "orders.", false},
+		{"orders.*", "orders.123.items", false},
+		{"*.items", "orders.items", true},
+		{"orders.*.items", "orders.123.items", true},
+		{"orders.*.items", "orders.123.other", false},
+		{"*", "orders", true},
+		{"*", "orders.123", false},
+		{"orders.1*", "orders.123", false},
+	} {
+		if got := matchChannel(tt.pattern, tt.channel); got != tt.match {
+			t.Errorf("Matching %s against %s Expected: %v Got: %v", tt.channel, tt.pattern, tt.match, got)
+		}
+	}
+	for channel, want := range map[string]bool{"orders.*": true, "*": true, "*.items": true, "a.*.b": true, "orders.1*": false, "orders": false} {
+		if got := isPattern(channel); got != want {
+			t.Errorf("%s Expected pattern: %v Got: %v", channel, want, got)
+		}
+	}
+}
+
+func TestPatternSubscriptions(t *testing.T) {
+	for _, shards := range []int{1, 4} {
+		srv := NewServer()
+		srv.Shards = shards
+		pattern := register(t, srv, "orders.*", 16)
+		both := &subscription{channels: []string{"orders.*", "orders.1"}, out: make(chan Event, 16)}
+		if _, err := srv.add(both); err != nil {
+			t.Fatal(err)
+		}
+		for i, c := range []string{"orders.1", "orders.2", "other.1", "orders.1.items"} {
+			srv.Publish([]string{c}, &testEvent{strconv.Itoa(i + 1), "", c})
+		}
+		if n := srv.SubscriberCount("orders.*"); n != 2 {
+			t.Errorf("Expected 2 subscribers to the pattern Got: %d", n)
+		}
+		if channels := srv.Channels(); !reflect.DeepEqual(channels, []string{"orders.*", "orders.1"}) {
+			t.Errorf("Expected: [orders.* orders.1] Got: %v", channels)
+		}
+		srv.Close()
+		for _, sub := range []*subscription{pattern, both} {
+			// Each event arrives once, although the second subscription
+			// matches orders.1 twice
+			var got []string
+			for ev := range sub.out {
+				got = append(got, ev.Id())
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, []string{"1", "2"}) {
+				t.Errorf("%d shards Expected: [1 2] Got: %v", shards, got)
+			}
+		}
+	}
+}
+
+func TestShards(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.Shards = 8
+	srv.PresenceChannel = "presence"
+	watcher := register(t, srv, "presence", 16)
+	channels := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	shards := make(map[*shard]bool)
+	for _, c := range channels {
+		shards[srv.owner(c)] = true
+	}
+	if len(shards) < 2 {
+		t.Fatalf("Expected the channels to be run by several shards Got: %d", len(shards))
+	}
+	ts := httptest.NewServer(srv.MultiHandler(channels))
+	defer ts.Close()
+	dec, done := subscribe(t, ts.URL, nil)
+	for _, c := range channels {
+		for srv.SubscriberCount(c) != 1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if n := srv.PublishCount(channels, &testEvent{"", "", "all"}); n != len(channels) {
+		t.Errorf("Expected to queue %d events Got: %d", len(channels), n)
+	}
+	// Events from different shards may arrive in any order
+	received := make(map[string]bool)
+	for range channels {
+		ev, err := dec.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		received[ev.Event()] = true
+	}
+	joined := make(map[string]bool)
+	for range channels {
+		var p presence
+		ev := <-watcher.out
+		json.Unmarshal([]byte(ev.Data()), &p)
+		joined[p.Channel] = ev.Event() == "subscriber-joined"
+	}
+	for _, c := range channels {
+		if !received[c] {
+			t.Errorf("Expected an event from %s", c)
+		}
+		if !joined[c] {
+			t.Errorf("Expected %s to be announced", c)
+		}
+	}
+	done()
+	for _, c := range channels {
+		for srv.SubscriberCount(c) != 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if got := srv.Channels(); !reflect.DeepEqual(got, []string{"presence"}) {
+		t.Errorf("Expected only the presence channel Got: %v", got)
+	}
+}
+
+func BenchmarkPublishChannels(b *testing.B) {
+	for _, shards := range []int{1, 8} {
+		b.Run("shards="+strconv.Itoa(shards), func(b *testing.B) {
+			srv := NewServer()
+			defer srv.Close()
+			srv.Shards = shards
+			srv.SendTimeout = time.Second
+			channels := make([]string, 256)
+			for i := range channels {
+				channels[i] = strconv.Itoa(i)
+				for j := 0; j < 16; j++ {
+					sub := register(b, srv, channels[i], 64)
+					go func() {
+						for range sub.out {
+						}
+					}()
+				}
+			}
+			ev := &testEvent{"", "", "data"}
+			var next atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					c := channels[next.Add(1)%int64(len(channels))]
+					srv.Publish([]string{c}, ev)
+				}
+			})
+		})
+	}
+}
+
+func TestRequireAcceptHeader(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.RequireAcceptHeader = true
+	ts := httptest.NewServer(srv.Handler("test"))
+	defer ts.Close()
+	for accept, want := range map[string]int{
+		"":                                    http.StatusNotAcceptable,
+		"text/html,*/*;q=0.8":                 http.StatusNotAcceptable,
+		"text/event-stream;q=0":               http.StatusNotAcceptable,
+		"text/event-stream":                   http.StatusOK,
+		"application/json, text/event-stream": http.StatusOK,
+	} {
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(accept) > 0 {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("Expected status for Accept %q: %d Got: %d", accept, want, resp.StatusCode)
+		}
+	}
+}
+
+func TestSubscribeRateLimit(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.SubscribeRateLimit = 0.5
+	ts := httptest.NewServer(srv.Handler("test"))
+	defer ts.Close()
+	for _, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		resp, err := http.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("Expected: %d Got: %d", want, resp.StatusCode)
+		}
+		if want == http.StatusTooManyRequests {
+			if after := resp.Header.Get("Retry-After"); after != "2" {
+				t.Errorf("Expected Retry-After: 2 Got: %q", after)
+			}
+		}
+	}
+}
+
+func TestSendSubscriberID(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.SendSubscriberID = true
+	ids := make(chan string, 1)
+	srv.OnSubscribe = func(channel string, r *http.Request) {
+		ids <- SubscriptionID(r)
+	}
+	ts := httptest.NewServer(srv.Handler("test"))
+	defer ts.Close()
+	dec, done := subscribe(t, ts.URL, nil)
+	defer done()
+	dec.Comments = make(chan string, 1)
+	go dec.Decode()
+	if got, want := <-dec.Comments, "id="+<-ids; got != want || len(want) == len("id=") {
+		t.Errorf("Expected: %s Got: %s", want, got)
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	srv := NewServer()
+	srv.Close()
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		srv.Close()
+		srv.Register("test", NewSliceRepository())
+		srv.Publish([]string{"test"}, &testEvent{"1", "", "data"})
+		srv.Broadcast(&testEvent{"2", "", "data"})
+		srv.PublishTo("id", &testEvent{"3", "", "data"})
+		srv.CloseChannel("test")
+		if n := srv.PublishCount([]string{"test"}, &testEvent{"4", "", "data"}); n != 0 {
+			t.Errorf("Expected: 0 Got: %d", n)
+		}
+		if n := srv.SubscriberCount("test"); n != 0 {
+			t.Errorf("Expected: 0 Got: %d", n)
+		}
+		if channels := srv.Channels(); len(channels) != 0 {
+			t.Errorf("Expected no channels Got: %v", channels)
+		}
+	}()
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the closed server not to block")
+	}
+}
+
+func TestHandlerWithInit(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	repo := NewSliceRepository()
+	repo.Add("test", &testEvent{"1", "", "replayed"})
+	srv.Register("test", repo)
+	srv.SnapshotFunc = func(channel string, r *http.Request) Event {
+		return &testEvent{"snapshot", "", "state"}
+	}
+	ts := httptest.NewServer(srv.HandlerWithInit("test", func(r *http.Request) Event {
+		return &testEvent{"", "init", r.URL.Query().Get("token")}
+	}))
+	defer ts.Close()
+	dec, done := subscribe(t, ts.URL+"?token=secret", http.Header{"Last-Event-Id": {"1"}})
+	defer done()
+	ev, err := dec.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Event() != "init" || ev.Data() != "secret" {
+		t.Errorf("Expected: init secret Got: %s %s", ev.Event(), ev.Data())
+	}
+	expectEvents(t, dec, "snapshot", "1")
+	for srv.SubscriberCount("test") != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	srv.Publish([]string{"test"}, &testEvent{"2", "", "live"})
+	expectEvents(t, dec, "2")
+}
+
+func TestDisableProxyBuffering(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Handler("test"))
+	defer ts.Close()
+	for _, want := range []string{"no", ""} {
+		resp, err := http.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("X-Accel-Buffering"); got != want {
+			t.Errorf("Expected: %q Got: %q", want, got)
+		}
+		srv.DisableProxyBuffering = false
+	}
+}
+
+func TestSnapshotFunc(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	repo := NewSliceRepository()
+	repo.Add("test", &testEvent{"1", "", "replayed"})
+	srv.Register("test", repo)
+	srv.SnapshotFunc = func(channel string, r *http.Request) Event {
+		return &testEvent{"", "snapshot", "state of " + channel}
+	}
+	ts := httptest.NewServer(srv.Handler("test"))
+	defer ts.Close()
+	dec, done := subscribe(t, ts.URL, http.Header{"Last-Event-Id": {"1"}})
+	defer done()
+	ev, err := dec.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Event() != "snapshot" || ev.Data() != "state of test" {
+		t.Errorf("Expected snapshot Got: %s %s", ev.Event(), ev.Data())
+	}
+	expectEvents(t, dec, "1")
+	srv.Publish([]string{"test"}, &testEvent{"2", "", "live"})
+	expectEvents(t, dec, "2")
+}
+
+func TestDeliveryPanic(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	errs := make(chan error, 1)
+	srv.OnError = func(channel string, err error) {
+		errs <- err
+	}
+	bad := register(t, srv, "test", 1)
+	close(bad.out)
+	good := register(t, srv, "test", 1)
+	srv.Publish([]string{"test"}, &testEvent{"1", "", "first"})
+	if err := <-errs; err == nil {
+		t.Error("Expected an error")
+	}
+	if n := srv.SubscriberCount("test"); n != 1 {
+		t.Errorf("Expected 1 subscriber Got: %d", n)
+	}
+	if ev := <-good.out; ev.Id() != "1" {
+		t.Errorf("Expected: 1 Got: %s", ev.Id())
+	}
+	srv.Publish([]string{"test"}, &testEvent{"2", "", "second"})
+	if ev := <-good.out; ev.Id() != "2" {
+		t.Errorf("Expected: 2 Got: %s", ev.Id())
+	}
+}
+
+// Hides the http.Flusher of the ResponseWriter it wraps
+type unflushable struct {
+	http.ResponseWriter
+}
+
+func TestNoFlusher(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	handler := srv.Handler("test")
+	w := httptest.NewRecorder()
+	handler(unflushable{w}, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected: %d Got: %d", http.StatusInternalServerError, w.Code)
+	}
+	if n := srv.SubscriberCount("test"); n != 0 {
+		t.Errorf("Expected no subscribers Got: %d", n)
+	}
+}
+
+func TestCoalesceKey(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.CoalesceKey = func(channel string, ev Event) string {
+		return ev.Event()
+	}
+	sub := register(t, srv, "prices", 8)
+	for _, ev := range []*testEvent{
+		{"1", "gbp", "1.20"},
+		{"2", "", "news"},
+		{"3", "gbp", "1.21"},
+		{"4", "usd", "0.98"},
+		{"5", "gbp", "1.22"},
+	} {
+		srv.Publish([]string{"prices"}, ev)
+	}
+	// Wait for the last event to be delivered
+	srv.SubscriberCount("prices")
+	for _, want := range []string{"5", "2", "4"} {
+		ev := sub.resolve(<-sub.out)
+		if ev.Id() != want {
+			t.Errorf("Expected: %s Got: %s", want, ev.Id())
+		}
+	}
+	select {
+	case ev := <-sub.out:
+		t.Errorf("Unexpected event: %s", sub.resolve(ev).Id())
+	default:
+	}
+}
+
+type countingMetrics struct {
+	sync.Mutex
+	counts map[string]int
+}
+
+func (m *countingMetrics) count(name, channel string) {
+	m.Lock()
+	defer m.Unlock()
+	m.counts[name+" "+channel]++
+}
+
+func (m *countingMetrics) EventPublished(channel string)    { m.count("published", channel) }
+func (m *countingMetrics) EventDelivered(channel string)    { m.count("delivered", channel) }
+func (m *countingMetrics) EventDropped(channel string)      { m.count("dropped", channel) }
+func (m *countingMetrics) SubscriberAdded(channel string)   { m.count("added", channel) }
+func (m *countingMetrics) SubscriberRemoved(channel string) { m.count("removed", channel) }
+
+func TestMetrics(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	metrics := &countingMetrics{counts: make(map[string]int)}
+	srv.Metrics = metrics
+	fast := register(t, srv, "test", 4)
+	register(t, srv, "test", 1)
+	for _, id := range []string{"1", "2"} {
+		srv.Publish([]string{"test"}, &testEvent{id, "", "data"})
+	}
+	srv.unsubscribe(fast)
+	srv.SubscriberCount("test")
+	metrics.Lock()
+	defer metrics.Unlock()
+	want := map[string]int{
+		"added test":     2,
+		"published test": 2,
+		"delivered test": 3,
+		"dropped test":   1,
+		"removed test":   2,
+	}
+	if !reflect.DeepEqual(metrics.counts, want) {
+		t.Errorf("Expected: %v Got: %v", want, metrics.counts)
+	}
+}
+
+func TestReplayAll(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	repo := NewSliceRepository()
+	for _, id := range []string{"1", "2", "3"} {
+		repo.Add("test", &testEvent{id, "", "replayed"})
+	}
+	srv.Register("test", repo)
+	srv.ReplayAll = true
+	ts := httptest.NewServer(srv.Handler("test"))
+	defer ts.Close()
+	dec, done := subscribe(t, ts.URL, nil)
+	defer done()
+	expectEvents(t, dec, "1", "2", "3")
+}
+
+func TestPublishCount(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	register(t, srv, "a", 1)
+	register(t, srv, "a", 0)
+	register(t, srv, "b", 1)
+	if n := srv.PublishCount([]string{"a", "b", "c"}, &testEvent{"1", "", "data"}); n != 2 {
+		t.Errorf("Expected: 2 Got: %d", n)
+	}
+	if n := srv.PublishCount([]string{"c"}, &testEvent{"2", "", "data"}); n != 0 {
+		t.Errorf("Expected: 0 Got: %d", n)
+	}
+}
+
+func TestPublishTo(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ids := make(chan string, 2)
+	srv.OnSubscribe = func(channel string, r *http.Request) {
+		ids <- SubscriptionID(r)
+	}
+	ts := httptest.NewServer(srv.Handler("test"))
+	defer ts.Close()
+	first, done := subscribe(t, ts.URL, nil)
+	defer done()
+	second, done := subscribe(t, ts.URL, nil)
+	defer done()
+	firstID, secondID := <-ids, <-ids
+	if len(firstID) == 0 || firstID == secondID {
+		t.Fatalf("Expected distinct ids Got: %q %q", firstID, secondID)
+	}
+	srv.PublishTo(secondID, &testEvent{"1", "", "direct"})
+	srv.PublishTo("unknown", &testEvent{"2", "", "lost"})
+	srv.Publish([]string{"test"}, &testEvent{"3", "", "everyone"})
+	expectEvents(t, second, "1", "3")
+	expectEvents(t, first, "3")
+}
+
+func TestResponseHeaders(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.ResponseHeaders = http.Header{
+		"Cache-Control":     {"no-cache"},
+		"X-Accel-Buffering": nil,
+		"X-Stream":          {"1"},
+	}
+	ts := httptest.NewServer(srv.Handler("test"))
+	defer ts.Close()
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	for k, want := range map[string]string{
+		"Cache-Control":     "no-cache",
+		"Content-Type":      "text/event-stream; charset=utf-8",
+		"X-Accel-Buffering": "",
+		"X-Stream":          "1",
+	} {
+		if got := resp.Header.Get(k); got != want {
+			t.Errorf("%s Expected: %q Got: %q", k, want, got)
+		}
+	}
+}
+
+func TestCORS(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		allowCORS      bool
+		allowedOrigins []string
+		origin         string
+		// The expected Access-Control-Allow-Origin, Access-Control-Allow-Credentials and Vary
+		want [3]string
+	}{
+		{"disabled", false, nil, "https://example.com", [3]string{"", "", ""}},
+		{"wildcard", true, nil, "https://example.com", [3]string{"*", "", ""}},
+		{"allowed origin", false, []string{"https://a.com", "https://example.com"}, "https://example.com",
+			[3]string{"https://example.com", "true", "Origin"}},
+		{"disallowed origin", false, []string{"https://a.com"}, "https://example.com", [3]string{"", "", "Origin"}},
+		{"disallowed origin falls back to wildcard", true, []string{"https://a.com"}, "https://example.com",
+			[3]string{"*", "", "Origin"}},
+		{"no origin", false, []string{"https://a.com"}, "", [3]string{"", "", "Origin"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			srv := NewServer()
+			defer srv.Close()
+			srv.AllowCORS = test.allowCORS
+			srv.AllowedOrigins = test.allowedOrigins
+			ts := httptest.NewServer(srv.Handler("test"))
+			defer ts.Close()
+			req, err := http.NewRequest("GET", ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(test.origin) > 0 {
+				req.Header.Set("Origin", test.origin)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			for i, k := range []string{"Access-Control-Allow-Origin", "Access-Control-Allow-Credentials", "Vary"} {
+				if got := resp.Header.Get(k); got != test.want[i] {
+					t.Errorf("%s Expected: %q Got: %q", k, test.want[i], got)
+				}
+			}
+		})
+	}
+}
+
+func TestEnableCompression(t *testing.T) {
+	srv := NewServer()
+	srv.EnableCompression = true
+	ts := httptest.NewServer(srv.Handler("test"))
+	defer ts.Close()
+	// Setting Accept-Encoding stops the client decompressing the response itself
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Encoding"); got != "gzip" {
+		t.Errorf("Expected Content-Encoding: gzip Got: %q", got)
+	}
+	if got := resp.Header.Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("Expected Vary: Accept-Encoding Got: %q", got)
+	}
+	// The gzip header only arrives if the stream is flushed before any events
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := NewDecoder(gz)
+	for _, id := range []string{"1", "2"} {
+		srv.Publish([]string{"test"}, &testEvent{id, "", "compressed"})
+		// Each event must be flushed through the compressor as it's sent
+		expectEvents(t, dec, id)
+	}
+	req.Header.Set("Accept-Encoding", "identity")
+	plain, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Body.Close()
+	if got := plain.Header.Get("Content-Encoding"); got != "" {
+		t.Errorf("Expected no Content-Encoding Got: %q", got)
+	}
+	if got := plain.Header.Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("Expected Vary: Accept-Encoding Got: %q", got)
+	}
+	// Only a compressed stream which was closed properly ends cleanly
+	srv.Close()
+	if _, err := dec.Decode(); err != io.EOF {
+		t.Errorf("Expected: %s Got: %v", io.EOF, err)
+	}
+}
+
+func TestContentTypeWithoutCharset(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.ResponseHeaders = http.Header{"Content-Type": {"text/event-stream"}}
+	ts := httptest.NewServer(srv.Handler("test"))
+	defer ts.Close()
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Values("Content-Type"); !reflect.DeepEqual(got, []string{"text/event-stream"}) {
+		t.Errorf("Expected: [text/event-stream] Got: %q", got)
+	}
+}
+
+func TestNoConnectionHeaderForHTTP2(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewUnstartedServer(srv.Handler("test"))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+	resp, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("Expected HTTP/2 Got: %s", resp.Proto)
+	}
+	if _, ok := resp.Header["Connection"]; ok {
+		t.Errorf("Unexpected Connection header: %q", resp.Header.Get("Connection"))
+	}
+}
+
+// Waits for release before reading the events to replay
+type blockingRepository struct {
+	*SliceRepository
+	release chan struct{}
+}
+
+func (repo *blockingRepository) Replay(channel, id string) chan Event {
+	out := make(chan Event)
+	go func() {
+		defer close(out)
+		<-repo.release
+		for ev := range repo.SliceRepository.Replay(channel, id) {
+			out <- ev
+		}
+	}()
+	return out
+}
+
+// Sends the first event, then stalls until released before sending the rest
+type stallingRepository struct {
+	*SliceRepository
+	release, finished chan struct{}
+}
+
+func (repo *stallingRepository) Replay(channel, id string) chan Event {
+	out := make(chan Event)
+	go func() {
+		defer close(repo.finished)
+		defer close(out)
+		first := true
+		for ev := range repo.SliceRepository.Replay(channel, id) {
+			out <- ev
+			if first {
+				<-repo.release
+				first = false
+			}
+		}
+	}()
+	return out
+}
+
+func TestReplayAbandoned(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	repo := &stallingRepository{NewSliceRepository(), make(chan struct{}), make(chan struct{})}
+	for i := 1; i <= 100; i++ {
+		repo.Add("test", &testEvent{strconv.Itoa(i), "", "replayed"})
+	}
+	srv.Register("test", repo)
+	ts := httptest.NewServer(srv.Handler("test"))
+	defer ts.Close()
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	req.Header.Set("Last-Event-ID", "0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for srv.SubscriberCount("test") != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	// The client goes away while the replay is stalled
+	resp.Body.Close()
+	for srv.SubscriberCount("test") != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(repo.release)
+	select {
+	case <-repo.finished:
+	case <-time.After(time.Second):
+		t.Error("Expected the rest of the replay to be discarded")
+	}
+}
+
+// Replays the events published at or after a time, taking each event's id as
+// when it was published in Unix milliseconds
+type timedRepository struct {
+	*SliceRepository
+}
+
+func (repo timedRepository) ReplaySince(channel string, t time.Time) <-chan Event {
+	return repo.Replay(channel, strconv.FormatInt(t.UnixMilli(), 10))
+}
+
+func TestReplaySince(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	repo := timedRepository{NewSliceRepository()}
+	for _, id := range []string{"1000", "2000", "3000"} {
+		repo.Add("test", &testEvent{id, "", "at " + id})
+	}
+	srv.Register("test", repo)
+	ts := httptest.NewServer(srv.Handler("test"))
+	defer ts.Close()
+	for _, tt := range []struct {
+		query, lastEventId string
+		want               []string
+	}{
+		{"?since=2000", "", []string{"2000", "3000"}},
+		// The last event id takes precedence
+		{"?since=2000", "3000", []string{"3000"}},
+		// Nothing is replayed for a time which isn't a number
+		{"?since=yesterday", "", nil},
+	} {
+		req, _ := http.NewRequest("GET", ts.URL+tt.query, nil)
+		if len(tt.lastEventId) > 0 {
+			req.Header.Set("Last-Event-ID", tt.lastEventId)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for srv.SubscriberCount("test") != 1 {
+			time.Sleep(time.Millisecond)
+		}
+		srv.Publish([]string{"test"}, &testEvent{"9000", "", "live"})
+		dec := NewDecoder(resp.Body)
+		for _, want := range append(tt.want, "9000") {
+			ev, err := dec.Decode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ev.Id() != want {
+				t.Errorf("%s Expected: %s Got: %s", tt.query, want, ev.Id())
+			}
+		}
+		resp.Body.Close()
+		for srv.SubscriberCount("test") != 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+// Fails partway through replaying
+type failingRepository struct {
+	err error
+}
+
+func (repo failingRepository) Replay(channel, id string) chan Event {
+	out := make(chan Event, 3)
+	out <- &testEvent{"2", "", "replayed"}
+	out <- &ReplayError{repo.err}
+	out <- &testEvent{"3", "", "ignored"}
+	close(out)
+	return out
+}
+
+func TestReplayError(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	failure := errors.New("disk on fire")
+	errs := make(chan error, 1)
+	srv.OnError = func(channel string, err error) {
+		errs <- err
+	}
+	srv.Register("test", failingRepository{failure})
+	ts := httptest.NewServer(srv.Handler("test"))
+	defer ts.Close()
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := <-errs; !errors.Is(err, failure) {
+		t.Errorf("Expected: %s Got: %v", failure, err)
+	}
+	srv.Publish([]string{"test"}, &testEvent{"4", "", "live"})
+	dec := NewDecoder(resp.Body)
+	for _, want := range []string{"2", ResyncEvent, "4"} {
+		ev, err := dec.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ev.Id() + ev.Event(); got != want {
+			t.Errorf("Expected: %q Got: %q", want, got)
+		}
+	}
+}
+
+func TestHasRepository(t *testing.T) {
+	srv := NewServer()
+	srv.Shards = 4
+	srv.Register("test", NewSliceRepository())
+	srv.Register("closed", NewSliceRepository())
+	srv.Register("deregistered", NewSliceRepository())
+	srv.Deregister("deregistered")
+	srv.CloseChannel("closed")
+	for channel, want := range map[string]bool{"test": true, "closed": false, "deregistered": false, "other": false} {
+		if got := srv.HasRepository(channel); got != want {
+			t.Errorf("%s Expected: %v Got: %v", channel, want, got)
+		}
+	}
+	srv.Close()
+	if srv.HasRepository("test") {
+		t.Error("Expected no repositories once closed")
+	}
+}
+
+type tenantKey struct{}
+
+// Only replays to clients whose request context carries the tenant
+type tenantRepository struct {
+	*SliceRepository
+	tenant string
+}
+
+func (repo *tenantRepository) ReplayContext(ctx context.Context, channel, id string) <-chan Event {
+	if ctx.Value(tenantKey{}) != repo.tenant {
+		out := make(chan Event)
+		close(out)
+		return out
+	}
+	return repo.Replay(channel, id)
+}
+
+func TestReplayContext(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	repo := &tenantRepository{NewSliceRepository(), "acme"}
+	repo.Add("test", &testEvent{"1", "", "first"})
+	repo.Add("test", &testEvent{"2", "", "second"})
+	srv.Register("test", repo)
+	handler := srv.Handler("test")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		tenant := req.URL.Query().Get("tenant")
+		handler(w, req.WithContext(context.WithValue(req.Context(), tenantKey{}, tenant)))
+	}))
+	defer ts.Close()
+	dec, done := subscribe(t, ts.URL+"?tenant=acme", http.Header{"Last-Event-Id": {"1"}})
+	defer done()
+	expectEvents(t, dec, "1", "2")
+	other, otherDone := subscribe(t, ts.URL+"?tenant=other", http.Header{"Last-Event-Id": {"1"}})
+	defer otherDone()
+	for srv.SubscriberCount("test") != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	srv.Publish([]string{"test"}, &testEvent{"3", "", "live"})
+	expectEvents(t, other, "3")
+}
+
+// Stores published events itself, keyed by name as well as channel
+type storingRepository struct {
+	*SliceRepository
+}
+
+func (repo storingRepository) Store(channel string, ev Event) error {
+	repo.Add(channel+"/"+ev.Event(), ev)
+	return nil
+}
+
+func (repo storingRepository) Replay(channel, id string) chan Event {
+	return repo.SliceRepository.Replay(channel+"/update", id)
+}
+
+func TestStorer(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	repo := storingRepository{NewSliceRepository()}
+	srv.Register("test", repo)
+	srv.Publish([]string{"test"}, &testEvent{"1", "update", "first"})
+	srv.Publish([]string{"test"}, &testEvent{"2", "delete", "ignored"})
+	srv.Publish([]string{"test"}, &testEvent{"3", "update", "second"})
+	// Stored although nobody is subscribed
+	srv.Broadcast(&testEvent{"4", "update", "broadcast"})
+	ts := httptest.NewServer(srv.Handler("test"))
+	defer ts.Close()
+	dec, done := subscribe(t, ts.URL, http.Header{"Last-Event-Id": {"1"}})
+	defer done()
+	expectEvents(t, dec, "1", "3", "4")
+}
+
+func TestBundledStorers(t *testing.T) {
+	for name, repo := range map[string]Repository{
+		"slice":       NewSliceRepository(),
+		"ring buffer": NewRingBufferRepository(8),
+		"ttl":         NewTTLRepository(time.Hour),
+		"file":        NewFileRepository(t.TempDir()),
+	} {
+		t.Run(name, func(t *testing.T) {
+			srv := NewServer()
+			defer srv.Close()
+			srv.ReplayAll = true
+			srv.Register("test", repo)
+			for _, id := range []string{"1", "2", "3"} {
+				srv.Publish([]string{"test"}, &testEvent{id, "", "stored"})
+			}
+			ts := httptest.NewServer(srv.Handler("test"))
+			defer ts.Close()
+			dec, done := subscribe(t, ts.URL, nil)
+			defer done()
+			expectEvents(t, dec, "1", "2", "3")
+		})
+	}
+}
+
+func TestStoreError(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	errs := make(chan error, 1)
+	srv.OnError = func(channel string, err error) {
+		errs <- err
+	}
+	srv.Register("test", NewFileRepository(filepath.Join(t.TempDir(), "missing")))
+	srv.Publish([]string{"test"}, &testEvent{"1", "", "unstorable"})
+	select {
+	case err := <-errs:
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Expected: %s Got: %v", os.ErrNotExist, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the error storing the event to be reported")
+	}
+}
+
+// Counts the calls to Replay
+type countingRepository struct {
+	*SliceRepository
+	replays atomic.Int32
+}
+
+func (repo *countingRepository) Replay(channel, id string) chan Event {
+	repo.replays.Add(1)
+	return repo.SliceRepository.Replay(channel, id)
+}
+
+func TestDisableReplay(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.DisableReplay = true
+	repo := &countingRepository{SliceRepository: NewSliceRepository()}
+	repo.Add("test", &testEvent{"1", "", "replayed"})
+	srv.Register("test", repo)
+	ts := httptest.NewServer(srv.Handler("test"))
+	defer ts.Close()
+	dec, done := subscribe(t, ts.URL, http.Header{"Last-Event-Id": {"1"}})
+	defer done()
+	for srv.SubscriberCount("test") != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	srv.Publish([]string{"test"}, &testEvent{"2", "", "live"})
+	expectEvents(t, dec, "2")
+	if n := repo.replays.Load(); n != 0 {
+		t.Errorf("Expected no replays Got: %d", n)
+	}
+}
+
+func TestReplayDeduplicated(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	repo := &blockingRepository{NewSliceRepository(), make(chan struct{})}
+	repo.Add("test", &testEvent{"1", "", "replayed"})
+	srv.Register("test", repo)
+	ts := httptest.NewServer(srv.Handler("test"))
+	defer ts.Close()
+	dec, done := subscribe(t, ts.URL, http.Header{"Last-Event-Id": {"1"}})
+	defer done()
+	// Published while replaying, so both queued and read from the repository
+	for _, id := range []string{"2", "3"} {
+		ev := &testEvent{id, "", "published"}
+		repo.Add("test", ev)
+		srv.Publish([]string{"test"}, ev)
+	}
+	close(repo.release)
+	srv.Publish([]string{"test"}, &testEvent{"4", "", "live"})
+	expectEvents(t, dec, "1", "2", "3", "4")
+}
+
+func TestMaxEventsPerSecond(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.MaxEventsPerSecond = 2
+	limited := 0
+	srv.OnRateLimited = func(channel string) {
+		limited++
+	}
+	sub := register(t, srv, "test", 8)
+	for i := 0; i < 5; i++ {
+		srv.Publish([]string{"test"}, &testEvent{strconv.Itoa(i), "", "data"})
+	}
+	srv.SubscriberCount("test")
+	if len(sub.out) != 2 || limited != 3 {
+		t.Errorf("Expected 2 sent and 3 limited Got: %d %d", len(sub.out), limited)
+	}
+	srv.BlockRateLimited = true
+	start := time.Now()
+	srv.Publish([]string{"test"}, &testEvent{"5", "", "data"})
+	srv.SubscriberCount("test")
+	if len(sub.out) != 3 {
+		t.Errorf("Expected 3 sent Got: %d", len(sub.out))
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Expected publishing to wait Got: %s", elapsed)
+	}
+}
+
+func TestRateLimitForgotten(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.clock = newFakeClock()
+	srv.MaxEventsPerSecond = 1
+	srv.OnRateLimited = func(string) {}
+	// Publishes two events to the channel at once, returning how many were sent
+	burst := func(channel string) int {
+		sub := register(t, srv, channel, 2)
+		defer srv.unsubscribe(sub)
+		srv.Publish([]string{channel}, &testEvent{"1", "", "limited"})
+		srv.Publish([]string{channel}, &testEvent{"2", "", "limited"})
+		srv.SubscriberCount(channel)
+		return len(sub.out)
+	}
+	// The allowance is full again each time the last subscriber leaves
+	for i := 0; i < 2; i++ {
+		if n := burst("a"); n != 1 {
+			t.Errorf("Expected 1 sent Got: %d", n)
+		}
+	}
+	// Unless there's a repository
+	srv.Register("b", NewSliceRepository())
+	for _, want := range []int{1, 0} {
+		if n := burst("b"); n != want {
+			t.Errorf("Expected %d sent Got: %d", want, n)
+		}
+	}
+	srv.CloseChannel("b")
+	if n := burst("b"); n != 1 {
+		t.Errorf("Expected 1 sent Got: %d", n)
+	}
+	// Nor is anything kept for a channel published to with nobody subscribed
+	for i := 0; i < 3; i++ {
+		srv.Publish([]string{"c"}, &testEvent{strconv.Itoa(i), "", "unheard"})
+	}
+	if n := burst("c"); n != 1 {
+		t.Errorf("Expected 1 sent Got: %d", n)
+	}
+}
+
+// Passes on Flush through Unwrap, as ResponseController expects
+type unwrapping struct {
+	http.ResponseWriter
+}
+
+func (u unwrapping) Unwrap() http.ResponseWriter { return u.ResponseWriter }
+
+func TestServerWriteTimeoutLifted(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	handler := srv.Handler("test")
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handler(unwrapping{w}, req)
+	}))
+	ts.Config.WriteTimeout = 50 * time.Millisecond
+	ts.Start()
+	defer ts.Close()
+	dec, done := subscribe(t, ts.URL, nil)
+	defer done()
+	time.Sleep(100 * time.Millisecond)
+	srv.Publish([]string{"test"}, &testEvent{"1", "", "late"})
+	expectEvents(t, dec, "1")
+}
+
+func TestInvalidEventSkipped(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	errs := make(chan error, 1)
+	srv.OnError = func(channel string, err error) {
+		errs <- err
+	}
+	ts := httptest.NewServer(srv.Handler("test"))
+	defer ts.Close()
+	dec, done := subscribe(t, ts.URL, nil)
+	defer done()
+	srv.Publish([]string{"test"}, &testEvent{"1\nevent: injected", "", "bad"})
+	srv.Publish([]string{"test"}, &testEvent{"2", "", "good"})
+	expectEvents(t, dec, "2")
+	if err := <-errs; !errors.Is(err, ErrInvalidField) {
+		t.Errorf("Expected: %s Got: %v", ErrInvalidField, err)
+	}
+}
+
+func TestServerMaxLineLength(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.MaxLineLength = 20
+	errs := make(chan error, 1)
+	srv.OnError = func(channel string, err error) {
+		errs <- err
+	}
+	ts := httptest.NewServer(srv.Handler("test"))
+	defer ts.Close()
+	dec, done := subscribe(t, ts.URL, nil)
+	defer done()
+	srv.Publish([]string{"test"}, &testEvent{"1", "", strings.Repeat("x", 20)})
+	srv.Publish([]string{"test"}, &testEvent{"2", "", "short\nlines"})
+	expectEvents(t, dec, "2")
+	if err := <-errs; !errors.Is(err, ErrLineTooLong) {
+		t.Errorf("Expected: %s Got: %v", ErrLineTooLong, err)
+	}
+}
+
+func TestHandlerFunc(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv.HandlerFunc(func(req *http.Request) string {
+		return req.URL.Query().Get("topic")
+	}))
+	defer ts.Close()
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected: %d Got: %d", http.StatusBadRequest, resp.StatusCode)
+	}
+	dec, done := subscribe(t, ts.URL+"?topic=news", nil)
+	defer done()
+	srv.Publish([]string{"sport"}, &testEvent{"1", "", "elsewhere"})
+	srv.Publish([]string{"news"}, &testEvent{"2", "", "headline"})
+	expectEvents(t, dec, "2")
+}
+
+func TestCloseChannel(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.Register("closing", NewSliceRepository())
+	ts := httptest.NewServer(srv.HandlerFunc(func(req *http.Request) string {
+		return req.URL.Query().Get("channel")
+	}))
+	defer ts.Close()
+	closing, done := subscribe(t, ts.URL+"?channel=closing", nil)
+	defer done()
+	open, done := subscribe(t, ts.URL+"?channel=open", nil)
+	defer done()
+	srv.Publish([]string{"closing"}, &testEvent{"1", "", "last"})
+	srv.CloseChannel("closing")
+	expectEvents(t, closing, "1")
+	if _, err := closing.Decode(); err != io.EOF {
+		t.Errorf("Expected: %s Got: %v", io.EOF, err)
+	}
+	if srv.SubscriberCount("closing") != 0 {
+		t.Error("Expected the channel to have no subscribers")
+	}
+	srv.Publish([]string{"open"}, &testEvent{"2", "", "still open"})
+	expectEvents(t, open, "2")
+}
+
+func TestEndOfStream(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.SendEndOfStream = true
+	// The end of the stream isn't filtered out
+	ts := httptest.NewServer(srv.FilteredHandler("test", func(ev Event) bool {
+		return len(ev.Id()) > 0
+	}))
+	defer ts.Close()
+	stream, err := Subscribe(ts.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	drainErrors(stream)
+	srv.Publish([]string{"test"}, &testEvent{"1", "", "last"})
+	srv.CloseChannel("test")
+	var got []string
+	for ev := range stream.Events {
+		got = append(got, ev.Id()+" "+ev.Event())
+	}
+	if want := []string{"1 ", " " + EndOfStreamEvent}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected: %q Got: %q", want, got)
+	}
+}
+
+func TestTap(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	first, stopFirst := srv.Tap()
+	second, stopSecond := srv.Tap()
+	defer stopSecond()
+	srv.Publish([]string{"a", "b"}, &testEvent{"1", "name", "published"})
+	stopFirst()
+	srv.Broadcast(&testEvent{"2", "", "broadcast"})
+	srv.PublishTo("5f2b", &testEvent{"3", "", "targeted"})
+	for _, want := range []string{
+		`{"channels":["a","b"],"id":"1","event":"name","data":"published"}`,
+		`{"id":"2","data":"broadcast"}`,
+		`{"subscription":"5f2b","id":"3","data":"targeted"}`,
+	} {
+		data, err := json.Marshal(<-second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("Expected: %s Got: %s", want, data)
+		}
+	}
+	if ev := <-first; ev.Event.Id() != "1" {
+		t.Errorf("Expected: 1 Got: %s", ev.Event.Id())
+	}
+	if _, ok := <-first; ok {
+		t.Error("Expected the stopped tap to be closed")
+	}
+}
+
+func TestChannelScopedIds(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	repo := NewRingBufferRepository(8)
+	for _, id := range []string{"1", "2", "3"} {
+		repo.Add("a", &testEvent{id, "", "a"})
+		repo.Add("b", &testEvent{id, "", "b"})
+	}
+	srv.Register("a", repo)
+	srv.Register("b", repo)
+	single := httptest.NewServer(srv.Handler("a"))
+	defer single.Close()
+	dec, done := subscribe(t, single.URL, http.Header{"Last-Event-Id": {"2"}})
+	expectEvents(t, dec, "3")
+	done()
+
+	multi := httptest.NewServer(srv.MultiHandler([]string{"a", "b"}))
+	defer multi.Close()
+	dec, done = subscribe(t, multi.URL, http.Header{"Last-Event-Id": {"a=2&b=1"}})
+	defer done()
+	for _, want := range []string{"a a=3&b=1", "b a=3&b=2", "b a=3&b=3"} {
+		ev, err := dec.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ev.Event() + " " + ev.Id(); got != want {
+			t.Errorf("Expected: %s Got: %s", want, got)
+		}
+	}
+}
+
+func TestPublishContext(t *testing.T) {
+	srv := NewServer()
+	srv.SendTimeout = time.Second
+	sub := register(t, srv, "test", 1)
+	tap, stop := srv.Tap()
+	defer stop()
+	ctx := context.Background()
+	if err := srv.PublishContext(ctx, []string{"test"}, &testEvent{"1", "", "queued"}); err != nil {
+		t.Fatal(err)
+	}
+	// Held up waiting for space in the full queue, once it has been tapped
+	go srv.Publish([]string{"test"}, &testEvent{"2", "", "waiting"})
+	for ev := range tap {
+		if ev.Event.Id() == "2" {
+			break
+		}
+	}
+	timeout, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := srv.PublishContext(timeout, []string{"test"}, &testEvent{"3", "", "abandoned"}); err != context.DeadlineExceeded {
+		t.Errorf("Expected: %s Got: %v", context.DeadlineExceeded, err)
+	}
+	<-sub.out
+	srv.Close()
+	if err := srv.PublishContext(ctx, []string{"test"}, &testEvent{"4", "", "closed"}); err != ErrServerClosed {
+		t.Errorf("Expected: %s Got: %v", ErrServerClosed, err)
+	}
+}
+
+func TestPreamble(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.Preamble = []byte(":" + strings.Repeat(" ", 2048) + "\n")
+	ts := httptest.NewServer(srv.Handler("test"))
+	defer ts.Close()
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	preamble := make([]byte, len(srv.Preamble))
+	if _, err := io.ReadFull(resp.Body, preamble); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(preamble, srv.Preamble) {
+		t.Errorf("Expected the preamble Got: %q", preamble)
+	}
+	srv.Publish([]string{"test"}, &testEvent{"1", "", "after the preamble"})
+	expectEvents(t, NewDecoder(resp.Body), "1")
+}
+
+type pushRecorder struct {
+	*httptest.ResponseRecorder
+	pushed chan string
+}
+
+func (r *pushRecorder) Push(target string, opts *http.PushOptions) error {
+	if r.Body.Len() > 0 || r.Flushed {
+		return errors.New("pushed after the stream started")
+	}
+	r.pushed <- target
+	return nil
+}
+
+func TestPushTargets(t *testing.T) {
+	srv := NewServer()
+	srv.PushTargets = []string{"/bootstrap.js", "/style.css"}
+	rec := &pushRecorder{httptest.NewRecorder(), make(chan string, 2)}
+	errs := make(chan error, 1)
+	srv.OnError = func(channel string, err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		srv.Handler("test")(rec, httptest.NewRequest("GET", "/events", nil))
+	}()
+	for srv.SubscriberCount("test") != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	srv.Close()
+	<-done
+	close(rec.pushed)
+	var pushed []string
+	for target := range rec.pushed {
+		pushed = append(pushed, target)
+	}
+	if !reflect.DeepEqual(pushed, srv.PushTargets) {
+		t.Errorf("Expected: %v Got: %v", srv.PushTargets, pushed)
+	}
+	select {
+	case err := <-errs:
+		t.Error(err)
+	default:
+	}
+	// Plain HTTP/1.1 clients are served as usual
+	srv = NewServer()
+	defer srv.Close()
+	srv.PushTargets = []string{"/bootstrap.js"}
+	ts := httptest.NewServer(srv.Handler("test"))
+	defer ts.Close()
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected: %d Got: %d", http.StatusOK, resp.StatusCode)
+	}
+}
@@ -1,99 +1,476 @@
 package eventsource
 
 import (
+	"context"
+	"errors"
 	"io"
 	"log"
+	"math/rand"
 	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Stream handles a connection for receiving Server Sent Events.
 // It will try and reconnect if the connection is lost, respecting both
 // received retry delays and event id's.
+// The delay before reconnecting starts from 3 seconds, until the server
+// sends a retry field, and grows after each failed attempt to reconnect,
+// as DefaultBackoff describes, unless the stream's Backoff is set.
+// It stops once the server sends an EndOfStreamEvent, or refuses the request
+// with a 401 or 403 status.
 type Stream struct {
-	c           http.Client
-	url         string
+	c           *http.Client
+	req         *http.Request
 	lastEventId string
 	retry       time.Duration
-	// Events emits the events received by the stream
+	ctx         context.Context
+	cancel      context.CancelFunc
+	// Events emits the events received by the stream. It is closed once the stream is closed.
 	Events chan Event
 	// Errors emits any errors encountered while reading events from the stream.
 	// It's mainly for informative purposes - the client isn't required to take any
 	// action when an error is encountered. The stream will always attempt to continue,
 	// even if that involves reconnecting to the server.
 	Errors chan error
+	// If set before Connect, each change to the state of the connection is sent to States. The stream waits for
+	// each change to be received, as for Errors, so it should be buffered or read from another goroutine. Closed
+	// is always the last change, after which States is closed, so it can be ranged over. Closed is sent in the
+	// background if nobody is receiving it yet, so that closing the stream isn't held up.
+	States chan StateChange
+	// If non-zero, the connection is dropped and remade if nothing, not even a comment, is received from the server
+	// within this interval, in case the connection has been lost without an error. Set it before Connect.
+	IdleTimeout time.Duration
+	// If non-zero, events whose id is among the last DedupWindow ids received are dropped rather than sent to Events
+	// again, such as those a server replays after reconnecting which had already arrived before the connection was
+	// lost. Only that many ids are remembered, so an event received longer ago than that, for instance before a long
+	// disconnection, is sent again. Events without an id are always sent, and an empty id field or a ResyncEvent,
+	// after which the server's history starts afresh, forgets the ids received before. Set it before Connect.
+	DedupWindow int
+	recent      *recentIds
+	// If set before Connect, ShouldRetry is called with each error which loses the connection or fails an attempt
+	// to reconnect, after it's sent to Errors, and the stream is closed rather than reconnecting if it returns
+	// false. By default the stream gives up after an HTTPError for a 401 Unauthorized or 403 Forbidden response,
+	// which reconnecting with the same request won't fix, and reconnects after any other error.
+	ShouldRetry func(err error) bool
+	// If set before Connect, Backoff returns how long to wait before each attempt to reconnect, given the number
+	// of attempts since the connection was lost, starting from 1, and the retry delay, which is 3 seconds until
+	// the server sends a retry field. Defaults to DefaultBackoff.
+	Backoff func(attempt int, retry time.Duration) time.Duration
+	// When anything was last received, in Unix nanoseconds
+	lastActivity atomic.Int64
+	clock        clock
+}
+
+// Reported on Errors when the connection is dropped because nothing was received within the IdleTimeout.
+var ErrIdleTimeout = errors.New("Eventsource: nothing received within IdleTimeout")
+
+// Returned by Connect, and sent to Errors when reconnecting, if the server responds with a status other than
+// 200 OK rather than an event stream. Whether the stream tries again depends on its ShouldRetry.
+type HTTPError struct {
+	StatusCode int
+}
+
+func (e *HTTPError) Error() string {
+	return "Eventsource: server responded with " + strconv.Itoa(e.StatusCode) + " " + http.StatusText(e.StatusCode)
+}
+
+// The state of a Stream's connection to the server
+type State int
+
+const (
+	// Making the first connection
+	Connecting State = iota
+	// Connected and receiving events
+	Open
+	// Waiting to reconnect after the connection was lost, or an attempt to reconnect failed
+	Reconnecting
+	// The stream has been closed, or failed to make its first connection, and won't reconnect
+	Closed
+)
+
+func (s State) String() string {
+	switch s {
+	case Connecting:
+		return "Connecting"
+	case Open:
+		return "Open"
+	case Reconnecting:
+		return "Reconnecting"
+	case Closed:
+		return "Closed"
+	}
+	return "State(" + strconv.Itoa(int(s)) + ")"
+}
+
+// A change to the state of a Stream's connection
+type StateChange struct {
+	State State
+	// When Reconnecting, the number of attempts to reconnect since the connection was lost, starting from 1,
+	// and how long the stream will wait before the attempt
+	Attempt int
+	Delay   time.Duration
 }
 
 // Subscribe to the Events emitted from the specified url.
 // If lastEventId is non-empty it will be sent to the server in case it can replay missed events.
 func Subscribe(url, lastEventId string) (*Stream, error) {
-	stream := &Stream{
-		url:         url,
+	return SubscribeWithContext(context.Background(), url, lastEventId)
+}
+
+// Subscribe to the Events emitted from the specified url, until the context is done or the stream is closed.
+func SubscribeWithContext(ctx context.Context, url, lastEventId string) (*Stream, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return SubscribeWith(lastEventId, http.DefaultClient, req)
+}
+
+// Subscribe to the Events emitted in response to a GET request, using the
+// specified client, or http.DefaultClient if it's nil, until the request's
+// context is done or the stream is closed. The request is copied for each
+// reconnection, with the latest Last-Event-ID, so any headers it carries such
+// as Authorization are sent every time. A Last-Event-ID header it carries is
+// used in place of an empty lastEventId, and like it is replaced, or removed
+// once the server resets the id. As the response is read for as long
+// as the stream is open, the client shouldn't have a Timeout; use the
+// timeouts of its Transport, such as the dialer's, instead.
+func SubscribeWith(lastEventId string, client *http.Client, req *http.Request) (*Stream, error) {
+	stream := NewStream(lastEventId, client, req)
+	if err := stream.Connect(); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Create a Stream like SubscribeWith, but without connecting to the server until Connect is called, so that
+// States can be set first.
+func NewStream(lastEventId string, client *http.Client, req *http.Request) *Stream {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if len(lastEventId) == 0 {
+		lastEventId = req.Header.Get("Last-Event-ID")
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	return &Stream{
+		c:           client,
+		req:         req,
 		lastEventId: lastEventId,
 		retry:       (time.Millisecond * 3000),
+		ctx:         ctx,
+		cancel:      cancel,
 		Events:      make(chan Event),
 		Errors:      make(chan error),
+		clock:       realClock{},
 	}
+}
+
+// Make the first connection to the server, then receive events in the background, reconnecting whenever the
+// connection is lost until the stream is closed. If the first connection fails, its error is returned and the
+// stream is closed. Connect must only be called once.
+func (stream *Stream) Connect() error {
+	stream.state(StateChange{State: Connecting})
 	r, err := stream.connect()
 	if err != nil {
-		return nil, err
+		stream.state(StateChange{State: Closed})
+		stream.cancel()
+		return err
 	}
-	go stream.stream(r)
-	return stream, nil
+	stream.state(StateChange{State: Open})
+	go stream.run(r)
+	return nil
+}
+
+// Close the connection and stop reconnecting.
+func (stream *Stream) Close() {
+	stream.cancel()
 }
 
 func (stream *Stream) connect() (r io.ReadCloser, err error) {
 	var resp *http.Response
-	var req *http.Request
-	if req, err = http.NewRequest("GET", stream.url, nil); err != nil {
-		return
+	req := stream.req.Clone(stream.ctx)
+	// Headers set by the caller, such as Authorization, are kept
+	for k, v := range map[string]string{"Cache-Control": "no-cache", "Accept": "text/event-stream"} {
+		if len(req.Header.Get(k)) == 0 {
+			req.Header.Set(k, v)
+		}
 	}
-	req.Header.Set("Cache-Control", "no-cache")
-	req.Header.Set("Accept", "text/event-stream")
+	// The caller's own header is stale once the server has reset the id
 	if len(stream.lastEventId) > 0 {
 		req.Header.Set("Last-Event-ID", stream.lastEventId)
+	} else {
+		req.Header.Del("Last-Event-ID")
 	}
 	if resp, err = stream.c.Do(req); err != nil {
 		return
 	}
-	r = resp.Body
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &HTTPError{resp.StatusCode}
+	}
+	stream.touch()
+	r = &activityReader{resp.Body, stream}
 	return
 }
 
-func (stream *Stream) stream(r io.ReadCloser) {
+// LastActivity returns when anything, including a comment, was last received from the server, or when the current
+// connection was made if that was later. It's the zero time until the first connection has been made.
+func (stream *Stream) LastActivity() time.Time {
+	if ns := stream.lastActivity.Load(); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Time{}
+}
+
+func (stream *Stream) touch() {
+	stream.lastActivity.Store(stream.clock.Now().UnixNano())
+}
+
+// Records activity whenever anything is read
+type activityReader struct {
+	io.ReadCloser
+	stream *Stream
+}
+
+func (a *activityReader) Read(p []byte) (int, error) {
+	n, err := a.ReadCloser.Read(p)
+	if n > 0 {
+		a.stream.touch()
+	}
+	return n, err
+}
+
+// Closes r once nothing has been received from it for the IdleTimeout, until the returned function is called,
+// which reports whether it was closed and can be called more than once
+func (stream *Stream) watchIdle(r io.Closer) (stop func() bool) {
+	done := make(chan struct{})
+	var once sync.Once
+	var expired atomic.Bool
+	go func() {
+		wait := stream.IdleTimeout
+		for {
+			select {
+			case <-done:
+				return
+			case <-stream.clock.After(wait):
+			}
+			if wait = stream.IdleTimeout - stream.clock.Now().Sub(stream.LastActivity()); wait > 0 {
+				continue
+			}
+			expired.Store(true)
+			r.Close()
+			return
+		}
+	}()
+	return func() bool {
+		once.Do(func() { close(done) })
+		return expired.Load()
+	}
+}
+
+func (stream *Stream) run(r io.ReadCloser) {
+	defer close(stream.Events)
+	defer close(stream.Errors)
+	defer stream.state(StateChange{State: Closed})
+	for {
+		if ended := stream.stream(r); ended {
+			return
+		}
+		if r = stream.reconnect(); r == nil {
+			return
+		}
+	}
+}
+
+// Reads events until the connection is lost, or returns true once the stream should stop, as the server has
+// ended it or the error losing the connection isn't worth retrying
+func (stream *Stream) stream(r io.ReadCloser) (ended bool) {
 	defer r.Close()
-	dec := newDecoder(r)
+	idle := func() bool { return false }
+	if stream.IdleTimeout > 0 {
+		idle = stream.watchIdle(r)
+		defer idle()
+	}
+	dec := NewDecoder(r)
 	for {
 		ev, err := dec.Decode()
 
 		if err != nil {
-			stream.Errors <- err
-			// respond to all errors by reconnecting and trying again
-			break
+			if idle() {
+				err = ErrIdleTimeout
+			}
+			stream.error(err)
+			if !stream.retryable(err) {
+				stream.cancel()
+				return true
+			}
+			return
 		}
 		pub := ev.(*publication)
 		if pub.Retry() > 0 {
-			stream.retry = time.Duration(pub.Retry()) * time.Millisecond
+			stream.retry = pub.Retry()
 		}
-		if len(pub.Id()) > 0 {
+		if pub.Id() == ResetId {
+			stream.lastEventId = ""
+		} else if len(pub.Id()) > 0 {
 			stream.lastEventId = pub.Id()
 		}
-		stream.Events <- ev
+		if stream.DedupWindow > 0 && stream.duplicate(pub) {
+			continue
+		}
+		select {
+		case stream.Events <- ev:
+		case <-stream.ctx.Done():
+			return
+		}
+		if pub.Event() == EndOfStreamEvent {
+			stream.cancel()
+			return true
+		}
 	}
-	backoff := stream.retry
-	for {
-		time.Sleep(backoff)
-		log.Printf("Reconnecting in %0.4f secs", backoff.Seconds())
+}
+
+// Reports whether the event's id has been received recently, remembering it if not
+func (stream *Stream) duplicate(ev Event) bool {
+	if stream.recent == nil {
+		stream.recent = newRecentIds(stream.DedupWindow)
+	}
+	switch {
+	case ev.Id() == ResetId || ev.Event() == ResyncEvent:
+		stream.recent = newRecentIds(stream.DedupWindow)
+	case len(ev.Id()) > 0:
+		return !stream.recent.add(ev.Id())
+	}
+	return false
+}
+
+// The last few ids received, forgetting the oldest once there are more than it holds
+type recentIds struct {
+	ids []string
+	// Where the next id goes once ids is full, over the oldest
+	next int
+	seen map[string]struct{}
+}
 
-		// NOTE: because of the defer we're opening the new connection
-		// before closing the old one. Shouldn't be a problem in practice,
-		// but something to be aware of.
-		next, err := stream.connect()
+func newRecentIds(size int) *recentIds {
+	return &recentIds{ids: make([]string, 0, size), seen: make(map[string]struct{}, size)}
+}
+
+// Remembers the id, reporting whether it's new
+func (r *recentIds) add(id string) bool {
+	if _, ok := r.seen[id]; ok {
+		return false
+	}
+	if len(r.ids) < cap(r.ids) {
+		r.ids = append(r.ids, id)
+	} else {
+		delete(r.seen, r.ids[r.next])
+		r.ids[r.next] = id
+		r.next = (r.next + 1) % len(r.ids)
+	}
+	r.seen[id] = struct{}{}
+	return true
+}
+
+// The most by which DefaultBackoff grows the delay beyond the retry delay
+const maxBackoff = time.Minute
+
+// DefaultBackoff is how long a Stream waits before an attempt to reconnect by default: the retry delay, plus a
+// random delay of up to the retry delay doubled after each failed attempt, capped at a minute. The random part
+// spreads out the clients reconnecting at once after the server restarts. Unlike full jitter, which waits a
+// random delay of up to the ceiling alone, the retry delay the server asks for is always waited for.
+func DefaultBackoff(attempt int, retry time.Duration) time.Duration {
+	ceiling := retry
+	for i := 1; i < attempt && ceiling < maxBackoff; i++ {
+		ceiling *= 2
+	}
+	if ceiling > maxBackoff {
+		ceiling = maxBackoff
+	}
+	if ceiling <= 0 {
+		return retry
+	}
+	return retry + time.Duration(rand.Int63n(int64(ceiling)))
+}
+
+// Returns the new connection, waiting longer after each failed attempt, or
+// nil if the stream is closed first
+func (stream *Stream) reconnect() io.ReadCloser {
+	next := stream.Backoff
+	if next == nil {
+		next = DefaultBackoff
+	}
+	for attempt := 1; ; attempt++ {
+		if stream.ctx.Err() != nil {
+			return nil
+		}
+		backoff := next(attempt, stream.retry)
+		stream.state(StateChange{Reconnecting, attempt, backoff})
+		log.Printf("Reconnecting in %0.4f secs", backoff.Seconds())
+		select {
+		case <-stream.clock.After(backoff):
+		case <-stream.ctx.Done():
+			return nil
+		}
+		r, err := stream.connect()
 		if err == nil {
-			go stream.stream(next)
-			break
+			stream.state(StateChange{State: Open})
+			return r
 		}
-		stream.Errors <- err
-		backoff *= 2
+		stream.error(err)
+		if !stream.retryable(err) {
+			stream.cancel()
+			return nil
+		}
+	}
+}
+
+func (stream *Stream) retryable(err error) bool {
+	if stream.ShouldRetry != nil {
+		return stream.ShouldRetry(err)
+	}
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode != http.StatusUnauthorized && httpErr.StatusCode != http.StatusForbidden
+	}
+	return true
+}
+
+// Sends the change to States, if it's set. Changes other than Closed are abandoned once the stream is
+// closed, while Closed is always delivered, then States is closed.
+func (stream *Stream) state(change StateChange) {
+	if stream.States == nil {
+		return
+	}
+	if change.State == Closed {
+		select {
+		case stream.States <- change:
+			close(stream.States)
+		default:
+			go func() {
+				stream.States <- change
+				close(stream.States)
+			}()
+		}
+		return
+	}
+	select {
+	case stream.States <- change:
+	case <-stream.ctx.Done():
+	}
+}
+
+func (stream *Stream) error(err error) {
+	if stream.ctx.Err() != nil {
+		// Closing the stream is the cause of the error
+		return
+	}
+	select {
+	case stream.Errors <- err:
+	case <-stream.ctx.Done():
 	}
 }
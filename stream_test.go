@@ -0,0 +1,546 @@
+package eventsource
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type connection struct {
+	lastEventId string
+	at          time.Time
+	header      http.Header
+}
+
+// Sends one event per connection, then disconnects
+type droppingServer struct {
+	retry       time.Duration
+	count       int32
+	connections chan connection
+}
+
+func newDroppingServer(retry time.Duration) (*httptest.Server, chan connection) {
+	s := &droppingServer{retry: retry, connections: make(chan connection, 16)}
+	return httptest.NewServer(s), s.connections
+}
+
+func (s *droppingServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.connections <- connection{req.Header.Get("Last-Event-ID"), time.Now(), req.Header}
+	id := strconv.Itoa(int(atomic.AddInt32(&s.count, 1)))
+	w.Header().Set("Content-Type", "text/event-stream")
+	NewEncoder(w).Encode(&retryEvent{testEvent{id, "", "dropping"}, s.retry})
+}
+
+func drainErrors(stream *Stream) {
+	go func() {
+		for range stream.Errors {
+		}
+	}()
+}
+
+func TestStreamReconnects(t *testing.T) {
+	ts, connections := newDroppingServer(10 * time.Millisecond)
+	defer ts.Close()
+	stream, err := Subscribe(ts.URL, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	drainErrors(stream)
+	for _, want := range []string{"1", "2", "3"} {
+		if ev := <-stream.Events; ev.Id() != want {
+			t.Errorf("Expected id: %s Got: %s", want, ev.Id())
+		}
+	}
+	stream.Close()
+	// Events is closed once the stream stops
+	for range stream.Events {
+	}
+	for _, want := range []string{"0", "1", "2"} {
+		if c := <-connections; c.lastEventId != want {
+			t.Errorf("Expected Last-Event-ID: %s Got: %s", want, c.lastEventId)
+		}
+	}
+}
+
+func TestStreamRetry(t *testing.T) {
+	retry := 200 * time.Millisecond
+	ts, connections := newDroppingServer(retry)
+	defer ts.Close()
+	stream, err := Subscribe(ts.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	drainErrors(stream)
+	<-stream.Events
+	<-stream.Events
+	first, second := <-connections, <-connections
+	// Well short of the default delay
+	if wait := second.at.Sub(first.at); wait < retry || wait > 2*time.Second {
+		t.Errorf("Expected to wait for %s Got: %s", retry, wait)
+	}
+}
+
+func TestSubscribeWithContext(t *testing.T) {
+	ts, _ := newDroppingServer(10 * time.Millisecond)
+	defer ts.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := SubscribeWithContext(ctx, ts.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	drainErrors(stream)
+	<-stream.Events
+	cancel()
+	for range stream.Events {
+	}
+	if _, err := SubscribeWithContext(ctx, ts.URL, ""); err == nil {
+		t.Error("Expected an error subscribing with a cancelled context")
+	}
+}
+
+type countingTransport struct {
+	requests int32
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&c.requests, 1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestSubscribeWith(t *testing.T) {
+	ts, _ := newDroppingServer(10 * time.Millisecond)
+	defer ts.Close()
+	transport := new(countingTransport)
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := SubscribeWith("", &http.Client{Transport: transport}, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	drainErrors(stream)
+	<-stream.Events
+	<-stream.Events
+	if n := atomic.LoadInt32(&transport.requests); n < 2 {
+		t.Errorf("Expected the client to be used for every connection Got: %d requests", n)
+	}
+	// A nil client is the default one
+	stream, err = SubscribeWith("", nil, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	drainErrors(stream)
+	if _, ok := <-stream.Events; !ok {
+		t.Error("Expected an event through the default client")
+	}
+}
+
+func TestSubscribeWithHeaders(t *testing.T) {
+	ts, connections := newDroppingServer(10 * time.Millisecond)
+	defer ts.Close()
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Accept", "text/event-stream, application/json")
+	stream, err := SubscribeWith("", http.DefaultClient, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	drainErrors(stream)
+	<-stream.Events
+	<-stream.Events
+	for _, want := range []string{"", "1"} {
+		c := <-connections
+		if c.lastEventId != want {
+			t.Errorf("Expected Last-Event-ID: %s Got: %s", want, c.lastEventId)
+		}
+		if auth := c.header.Get("Authorization"); auth != "Bearer secret" {
+			t.Errorf("Expected Authorization: Bearer secret Got: %s", auth)
+		}
+		if accept := c.header.Get("Accept"); accept != "text/event-stream, application/json" {
+			t.Errorf("Expected Accept: text/event-stream, application/json Got: %s", accept)
+		}
+	}
+}
+
+func TestStreamResetId(t *testing.T) {
+	connections := make(chan string, 16)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		connections <- req.Header.Get("Last-Event-ID")
+		w.Header().Set("Content-Type", "text/event-stream")
+		NewEncoder(w).Encode(&retryEvent{testEvent{ResetId, "", "reset"}, 10 * time.Millisecond})
+	}))
+	defer ts.Close()
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Event-ID", "42")
+	stream, err := SubscribeWith("", http.DefaultClient, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	drainErrors(stream)
+	<-stream.Events
+	<-stream.Events
+	for _, want := range []string{"42", ""} {
+		if got := <-connections; got != want {
+			t.Errorf("Expected Last-Event-ID: %q Got: %q", want, got)
+		}
+	}
+}
+
+func TestStreamStates(t *testing.T) {
+	ts, _ := newDroppingServer(10 * time.Millisecond)
+	defer ts.Close()
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := NewStream("", http.DefaultClient, req)
+	stream.States = make(chan StateChange, 16)
+	stream.Backoff = func(attempt int, retry time.Duration) time.Duration {
+		return time.Duration(attempt) * retry
+	}
+	if err := stream.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	drainErrors(stream)
+	<-stream.Events
+	<-stream.Events
+	stream.Close()
+	for range stream.Events {
+	}
+	for _, want := range []StateChange{
+		{State: Connecting},
+		{State: Open},
+		{Reconnecting, 1, 10 * time.Millisecond},
+		{State: Open},
+	} {
+		if got := <-stream.States; got != want {
+			t.Errorf("Expected: %+v Got: %+v", want, got)
+		}
+	}
+	var last StateChange
+	for len(stream.States) > 0 {
+		last = <-stream.States
+	}
+	if last.State != Closed {
+		t.Errorf("Expected the last state to be %s Got: %s", Closed, last.State)
+	}
+}
+
+func TestDefaultBackoff(t *testing.T) {
+	for _, test := range []struct {
+		attempt int
+		retry   time.Duration
+		ceiling time.Duration
+	}{
+		{1, time.Second, time.Second},
+		{2, time.Second, 2 * time.Second},
+		{4, time.Second, 8 * time.Second},
+		{10, time.Second, time.Minute},
+		{100, 3 * time.Second, time.Minute},
+		{3, 2 * time.Minute, time.Minute},
+		{1, 0, 0},
+	} {
+		for i := 0; i < 100; i++ {
+			d := DefaultBackoff(test.attempt, test.retry)
+			if d < test.retry || (test.ceiling > 0 && d >= test.retry+test.ceiling) {
+				t.Fatalf("Expected attempt %d with retry %s to wait in [%s, %s) Got: %s",
+					test.attempt, test.retry, test.retry, test.retry+test.ceiling, d)
+			}
+		}
+	}
+}
+
+func TestStreamClosedState(t *testing.T) {
+	ts, _ := newDroppingServer(10 * time.Millisecond)
+	defer ts.Close()
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := NewStream("", http.DefaultClient, req)
+	stream.States = make(chan StateChange)
+	connected := make(chan error, 1)
+	go func() { connected <- stream.Connect() }()
+	for _, want := range []State{Connecting, Open} {
+		if got := <-stream.States; got.State != want {
+			t.Errorf("Expected: %s Got: %s", want, got.State)
+		}
+	}
+	if err := <-connected; err != nil {
+		t.Fatal(err)
+	}
+	drainErrors(stream)
+	// Nobody is receiving States while the stream closes
+	stream.Close()
+	for range stream.Events {
+	}
+	var last StateChange
+	for change := range stream.States {
+		last = change
+	}
+	if last.State != Closed {
+		t.Errorf("Expected the last state to be %s Got: %s", Closed, last.State)
+	}
+}
+
+func TestConnectFails(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	url := ts.URL
+	ts.Close()
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := NewStream("", http.DefaultClient, req)
+	stream.States = make(chan StateChange, 2)
+	if err := stream.Connect(); err == nil {
+		t.Fatal("Expected an error connecting to a closed server")
+	}
+	for _, want := range []State{Connecting, Closed} {
+		if got := <-stream.States; got.State != want {
+			t.Errorf("Expected: %s Got: %s", want, got.State)
+		}
+	}
+}
+
+// Sends one event per connection, then goes silent without disconnecting
+func silentServer(connections chan time.Time) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		connections <- time.Now()
+		w.Header().Set("Content-Type", "text/event-stream")
+		NewEncoder(w).Encode(&retryEvent{testEvent{"1", "", "silent"}, 10 * time.Millisecond})
+		w.(http.Flusher).Flush()
+		<-req.Context().Done()
+	}
+}
+
+func TestStreamIdleTimeout(t *testing.T) {
+	connections := make(chan time.Time, 16)
+	ts := httptest.NewServer(silentServer(connections))
+	defer ts.Close()
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := NewStream("", http.DefaultClient, req)
+	stream.IdleTimeout = 50 * time.Millisecond
+	if err := stream.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	<-stream.Events
+	if err := <-stream.Errors; err != ErrIdleTimeout {
+		t.Errorf("Expected: %s Got: %v", ErrIdleTimeout, err)
+	}
+	<-stream.Events
+	first, second := <-connections, <-connections
+	if wait := second.Sub(first); wait < 50*time.Millisecond {
+		t.Errorf("Expected to reconnect after the IdleTimeout Got: %s", wait)
+	}
+	if since := time.Since(stream.LastActivity()); since > time.Second {
+		t.Errorf("Expected recent activity Got: %s ago", since)
+	}
+}
+
+// Sends ids 1 and 2, then on reconnecting replays 2 before sending 3
+type replayingServer struct {
+	count int32
+}
+
+func (s *replayingServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	enc := NewEncoder(w)
+	ids := []string{"1", "2"}
+	if atomic.AddInt32(&s.count, 1) > 1 {
+		ids = []string{"2", "3"}
+	}
+	for _, id := range ids {
+		enc.Encode(&retryEvent{testEvent{id, "", "replaying"}, 10 * time.Millisecond})
+	}
+}
+
+func TestStreamDedupWindow(t *testing.T) {
+	ts := httptest.NewServer(&replayingServer{})
+	defer ts.Close()
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := NewStream("", http.DefaultClient, req)
+	stream.DedupWindow = 2
+	if err := stream.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	drainErrors(stream)
+	// Each reconnection replays 2 and then 3, which are still remembered
+	for _, want := range []string{"1", "2", "3"} {
+		if ev := <-stream.Events; ev.Id() != want {
+			t.Errorf("Expected id: %s Got: %s", want, ev.Id())
+		}
+	}
+	select {
+	case ev := <-stream.Events:
+		t.Errorf("Expected no more events Got: %s", ev.Id())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRecentIds(t *testing.T) {
+	r := newRecentIds(2)
+	for _, tt := range []struct {
+		id  string
+		new bool
+	}{{"1", true}, {"2", true}, {"1", false}, {"3", true}, {"2", false}, {"1", true}} {
+		if got := r.add(tt.id); got != tt.new {
+			t.Errorf("Adding %s Expected new: %v Got: %v", tt.id, tt.new, got)
+		}
+	}
+}
+
+// Responds with each status in turn, then sends an event for each connection after that
+func statusServer(statuses ...int) http.HandlerFunc {
+	var count int32
+	return func(w http.ResponseWriter, req *http.Request) {
+		if n := int(atomic.AddInt32(&count, 1)); n <= len(statuses) && statuses[n-1] != http.StatusOK {
+			w.WriteHeader(statuses[n-1])
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		NewEncoder(w).Encode(&retryEvent{testEvent{"1", "", "ok"}, 10 * time.Millisecond})
+	}
+}
+
+func TestStreamHTTPError(t *testing.T) {
+	ts := httptest.NewServer(statusServer(http.StatusUnauthorized))
+	defer ts.Close()
+	_, err := Subscribe(ts.URL, "")
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected: HTTPError 401 Got: %v", err)
+	}
+}
+
+func TestStreamRetriesServerErrors(t *testing.T) {
+	// Reconnects after the 503, then gives up after the 403
+	ts := httptest.NewServer(statusServer(http.StatusOK, http.StatusServiceUnavailable, http.StatusOK, http.StatusForbidden))
+	defer ts.Close()
+	stream, err := Subscribe(ts.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	statuses := make(chan int, 8)
+	go func() {
+		defer close(statuses)
+		for err := range stream.Errors {
+			var httpErr *HTTPError
+			if errors.As(err, &httpErr) {
+				statuses <- httpErr.StatusCode
+			}
+		}
+	}()
+	events := 0
+	for range stream.Events {
+		events++
+	}
+	if events != 2 {
+		t.Errorf("Expected 2 events Got: %d", events)
+	}
+	var got []int
+	for status := range statuses {
+		got = append(got, status)
+	}
+	if want := []int{http.StatusServiceUnavailable, http.StatusForbidden}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected: %v Got: %v", want, got)
+	}
+}
+
+func TestStreamShouldRetryStops(t *testing.T) {
+	// Gives up after the 404, which the default would retry
+	ts := httptest.NewServer(statusServer(http.StatusOK, http.StatusNotFound, http.StatusOK))
+	defer ts.Close()
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := NewStream("", http.DefaultClient, req)
+	stream.ShouldRetry = func(err error) bool {
+		var httpErr *HTTPError
+		return !errors.As(err, &httpErr) || httpErr.StatusCode < 400 || httpErr.StatusCode >= 500
+	}
+	if err := stream.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	last := make(chan error, 1)
+	go func() {
+		var err error
+		for err = range stream.Errors {
+		}
+		last <- err
+	}()
+	events := 0
+	for range stream.Events {
+		events++
+	}
+	if events != 1 {
+		t.Errorf("Expected 1 event Got: %d", events)
+	}
+	var httpErr *HTTPError
+	if err := <-last; !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected: HTTPError 404 Got: %v", err)
+	}
+}
+
+func TestStreamShouldRetryRetries(t *testing.T) {
+	// Reconnects after the 401, which the default would give up on
+	ts := httptest.NewServer(statusServer(http.StatusOK, http.StatusUnauthorized, http.StatusOK))
+	defer ts.Close()
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := NewStream("", http.DefaultClient, req)
+	var unauthorized atomic.Bool
+	stream.ShouldRetry = func(err error) bool {
+		var httpErr *HTTPError
+		if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusUnauthorized {
+			unauthorized.Store(true)
+		}
+		return true
+	}
+	if err := stream.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	drainErrors(stream)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-stream.Events:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected 2 events Got: %d", i)
+		}
+	}
+	if !unauthorized.Load() {
+		t.Error("Expected ShouldRetry to be called with HTTPError 401")
+	}
+}
@@ -0,0 +1,291 @@
+package eventsource
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The opcodes of the WebSocket frames used, from RFC 6455
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xa
+)
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var (
+	errNotWebSocket  = errors.New("Eventsource: not a WebSocket handshake")
+	errFrameTooLarge = errors.New("Eventsource: WebSocket frame too large")
+)
+
+// An event as sent in a WebSocket message
+type wsEvent struct {
+	Id    string `json:"id,omitempty"`
+	Event string `json:"event,omitempty"`
+	Data  string `json:"data"`
+}
+
+// Create a new handler serving a specified channel over WebSockets, for
+// clients behind proxies which break long-lived event streams but let
+// WebSockets through. Each event is sent as a text message holding a JSON
+// object with its id, name and data, such as {"id":"1","data":"hello"}. The
+// Server's options apply as they do to Handler, including SnapshotFunc,
+// apart from those particular to event streams: AllowCORS, AllowedOrigins,
+// EnableCompression, FlushInterval, HeartbeatByte, MaxLineLength, Preamble,
+// PushTargets, RequireAcceptHeader, ResponseHeaders, DisableProxyBuffering,
+// and SendSubscriberID, as messages have no comments to carry the id in.
+// Keepalives are sent as pings. As browsers can't set headers on a WebSocket,
+// clients resume by passing their last event id in the LastEventIdParam query
+// parameter.
+func (srv *Server) WebSocketHandler(channel string) http.HandlerFunc {
+	channels := []string{channel}
+	return func(w http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get("Sec-WebSocket-Key")
+		if !headerHas(req.Header, "Connection", "upgrade") || !headerHas(req.Header, "Upgrade", "websocket") || len(key) == 0 {
+			http.Error(w, errNotWebSocket.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Header.Get("Sec-WebSocket-Version") != "13" {
+			w.Header().Set("Sec-WebSocket-Version", "13")
+			http.Error(w, errNotWebSocket.Error(), http.StatusUpgradeRequired)
+			return
+		}
+		if !srv.admit(w, req, channels) {
+			return
+		}
+		id := newSubscriptionID()
+		req = req.WithContext(context.WithValue(req.Context(), subscriptionIDKey{}, id))
+		sub := &subscription{
+			id:           id,
+			channels:     channels,
+			lastEventIds: []string{srv.lastEventId(req)},
+			since:        srv.since(req),
+			out:          make(chan Event, srv.bufferSize()),
+			remoteAddr:   req.RemoteAddr,
+			connectedAt:  srv.clock.Now(),
+			lastEventID:  srv.lastEventId(req),
+		}
+		accepted, err := srv.add(sub)
+		defer srv.handlers.Add(-accepted)
+		if err != nil {
+			srv.unsubscribe(sub)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			srv.unsubscribe(sub)
+			srv.error(channel, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer conn.Close()
+		ws := &wsConn{conn, srv.WriteTimeout}
+		if err := ws.handshake(key); err != nil {
+			srv.unsubscribe(sub)
+			srv.error(channel, err)
+			return
+		}
+		if srv.OnSubscribe != nil {
+			srv.OnSubscribe(channel, req)
+		}
+		if srv.OnUnsubscribe != nil {
+			defer srv.OnUnsubscribe(channel)
+		}
+		// Reads what the client sends, answering its pings, until it goes away.
+		// The request's context isn't done when a hijacked client goes away, so
+		// replaying watches ctx instead.
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+		gone := make(chan struct{})
+		pings := make(chan []byte, 1)
+		go func() {
+			defer close(gone)
+			defer cancel()
+			for {
+				op, payload, err := readFrame(rw.Reader, DefaultMaxEventSize)
+				if err != nil || op == wsClose {
+					return
+				}
+				if op == wsPing {
+					select {
+					case pings <- payload:
+					default:
+					}
+				}
+			}
+		}()
+		if srv.SnapshotFunc != nil {
+			if ev := srv.SnapshotFunc(channel, req); ev != nil {
+				if err := sub.wrote(ws.writeEvent(ev)); err != nil {
+					srv.unsubscribe(sub)
+					srv.error(channel, err)
+					return
+				}
+			}
+		}
+		recent, err := srv.catchUp(ctx, sub, channel, func(ev Event) error {
+			return sub.wrote(ws.writeEvent(ev))
+		})
+		if err != nil {
+			srv.unsubscribe(sub)
+			if ctx.Err() == nil {
+				srv.error(channel, err)
+			}
+			return
+		}
+		replayed := newReplayFilter(recent, len(sub.out))
+		var tick <-chan time.Time
+		if srv.KeepAlive > 0 {
+			keepalive := srv.clock.NewTicker(srv.KeepAlive)
+			defer keepalive.Stop()
+			tick = keepalive.C()
+		}
+		for {
+			var err error
+			select {
+			case <-gone:
+				srv.unsubscribe(sub)
+				return
+			case payload := <-pings:
+				err = ws.write(wsPong, payload)
+			case <-tick:
+				err = ws.write(wsPing, nil)
+			case ev, ok := <-sub.out:
+				if !ok {
+					// 1000 is a normal closure
+					ws.write(wsClose, []byte{0x03, 0xe8})
+					return
+				}
+				if ev = sub.resolve(ev); ev != endOfStream && !sub.accepts(ev) {
+					continue
+				}
+				if replayed.duplicate(ev) {
+					continue
+				}
+				err = sub.wrote(ws.writeEvent(ev))
+			}
+			if err != nil {
+				srv.unsubscribe(sub)
+				srv.error(channel, err)
+				return
+			}
+		}
+	}
+}
+
+// Reports whether any of the comma separated values of the header is value
+func headerHas(h http.Header, name, value string) bool {
+	for _, v := range h.Values(name) {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The server's end of a WebSocket connection
+type wsConn struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (ws *wsConn) handshake(key string) error {
+	hash := sha1.Sum([]byte(key + wsGUID))
+	_, err := io.WriteString(ws.conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: "+base64.StdEncoding.EncodeToString(hash[:])+"\r\n\r\n")
+	return err
+}
+
+func (ws *wsConn) writeEvent(ev Event) error {
+	id := ev.Id()
+	if id == ResetId {
+		id = ""
+	}
+	msg, err := json.Marshal(wsEvent{id, ev.Event(), ev.Data()})
+	if err != nil {
+		return err
+	}
+	return ws.write(wsText, msg)
+}
+
+// Writes a single unmasked frame, as sent by servers
+func (ws *wsConn) write(opcode byte, payload []byte) error {
+	if ws.timeout > 0 {
+		ws.conn.SetWriteDeadline(time.Now().Add(ws.timeout))
+	}
+	frame := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	_, err := ws.conn.Write(append(frame, payload...))
+	return err
+}
+
+// Reads a single frame, unmasking it if it was masked, as frames sent by
+// clients are. Frames with payloads larger than limit aren't read.
+func readFrame(r *bufio.Reader, limit int) (opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(r, head[:]); err != nil {
+		return
+	}
+	opcode = head[0] & 0x0f
+	n := uint64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var size [2]byte
+		if _, err = io.ReadFull(r, size[:]); err != nil {
+			return
+		}
+		n = uint64(binary.BigEndian.Uint16(size[:]))
+	case 127:
+		var size [8]byte
+		if _, err = io.ReadFull(r, size[:]); err != nil {
+			return
+		}
+		n = binary.BigEndian.Uint64(size[:])
+	}
+	var mask [4]byte
+	masked := head[1]&0x80 != 0
+	if masked {
+		if _, err = io.ReadFull(r, mask[:]); err != nil {
+			return
+		}
+	}
+	if n > uint64(limit) {
+		return opcode, nil, errFrameTooLarge
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}